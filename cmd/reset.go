@@ -17,12 +17,9 @@ package cmd
 import (
 	"fmt"
 	"log"
-	"os"
-	"path/filepath"
 
 	"github.com/cleverdata/sift-agent/internal/db"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 )
 
 var resetPath string
@@ -33,22 +30,7 @@ var resetCmd = &cobra.Command{
 	Long:  `Clears the local SQLite database that tracks uploaded files. Use this to force the agent to re-upload files it has already processed.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		// Initialize DB first
-		var dbPath string
-		if viper.IsSet("db_path") {
-			dbPath = viper.GetString("db_path")
-		} else if localMode {
-			exePath, _ := os.Executable()
-			dbPath = filepath.Join(filepath.Dir(exePath), "state.db")
-		} else {
-			var dataDir string
-			if os.Getenv("OS") == "Windows_NT" {
-				dataDir = filepath.Join(os.Getenv("ProgramData"), "Sift")
-			} else {
-				dataDir = "/var/lib/sift-agent"
-			}
-			dbPath = filepath.Join(dataDir, "state.db")
-		}
-		db.Init(dbPath)
+		db.Init(resolveDBPath())
 
 		if resetPath != "" {
 			fmt.Printf("Clearing history for: %s\n", resetPath)
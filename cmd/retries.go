@@ -0,0 +1,62 @@
+// Copyright 2026 CleverData
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/db"
+	"github.com/spf13/cobra"
+)
+
+var retriesCmd = &cobra.Command{
+	Use:     "retries",
+	Aliases: []string{"schedule"},
+	Short:   "Show files waiting for a scheduled retry",
+	Long: `Lists files whose last attempt failed or could not be confirmed, with the
+time the agent will try them again. Schedules survive restarts.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := db.Init(resolveDBPath()); err != nil {
+			log.Fatalf("Database initialization failed: %v", err)
+		}
+
+		retries := db.ListRetries()
+		if len(retries) == 0 {
+			fmt.Println("No retries scheduled.")
+			return
+		}
+
+		fmt.Printf("% -15s % -7s % -10s % -22s %s\n", "REMOTE", "ERRORS", "STATUS", "NEXT ATTEMPT", "FILE")
+		fmt.Println("--------------------------------------------------------------------------------")
+		for _, r := range retries {
+			fmt.Printf("% -15s %-7d % -10s % -22s %s\n", r.Remote, r.ErrorCount, r.Status, untilLabel(r.NextAttempt), r.Path)
+		}
+	},
+}
+
+// untilLabel renders a scheduled time relative to now, e.g. "in 4m (14:05:00)".
+func untilLabel(at time.Time) string {
+	d := time.Until(at).Round(time.Second)
+	if d <= 0 {
+		return "due now"
+	}
+	return fmt.Sprintf("in %s (%s)", d, at.Format(time.TimeOnly))
+}
+
+func init() {
+	rootCmd.AddCommand(retriesCmd)
+}
@@ -100,3 +100,29 @@ func initConfig() {
 		viper.SetConfigFile(viper.ConfigFileUsed())
 	}
 }
+
+// resolveMachineKeyPath returns the key file sealed secrets are encrypted
+// with: machine_key_file from the config, or machine.key next to the state
+// database.
+func resolveMachineKeyPath() string {
+	if viper.IsSet("machine_key_file") {
+		return viper.GetString("machine_key_file")
+	}
+	return filepath.Join(filepath.Dir(resolveDBPath()), "machine.key")
+}
+
+// resolveDBPath returns the state database location: db_path from the config,
+// the executable's folder in local mode, or the system data directory.
+func resolveDBPath() string {
+	if viper.IsSet("db_path") {
+		return viper.GetString("db_path")
+	}
+	if localMode {
+		exePath, _ := os.Executable()
+		return filepath.Join(filepath.Dir(exePath), "state.db")
+	}
+	if os.Getenv("OS") == "Windows_NT" {
+		return filepath.Join(os.Getenv("ProgramData"), "Sift", "state.db")
+	}
+	return "/var/lib/sift-agent/state.db"
+}
@@ -0,0 +1,209 @@
+// Copyright 2026 CleverData
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/api"
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var remoteRotateKeyCmd = &cobra.Command{
+	Use:   "rotate-key [name]",
+	Short: "Replace the API key of a remote without downtime",
+	Long: `Verifies the new key against the server's /agent/check, then makes it the
+remote's key. The previous key is kept as secondary_key, so uploads still
+using it finish and the agent falls back to it if the new key is not active
+on the server yet. The running agent picks up the new key without a restart.
+
+A key read from key_file is replaced in that file, and the previous key is
+sealed in the config file. Keys read from key_env cannot be rotated here.
+Sealed keys stay sealed, --encrypt seals keys stored in clear text.
+
+Once the old key is revoked, remove it with --drop-old. A destination of a
+fan-out remote is named <remote>/<destination>, as in 'sift remote ls'.`,
+	Example: `  sift remote rotate-key scans --key "sk_new..."
+  sift remote rotate-key scans --drop-old`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name := args[0]
+		key, _ := cmd.Flags().GetString("key")
+		dropOld, _ := cmd.Flags().GetBool("drop-old")
+		encrypt, _ := cmd.Flags().GetBool("encrypt")
+		if key == "" && !dropOld {
+			fmt.Println("Error: --key or --drop-old is required.")
+			return
+		}
+
+		var remotes []config.RemoteConfig
+		if err := viper.UnmarshalKey("remotes", &remotes); err != nil {
+			fmt.Println("No remotes configured.")
+			return
+		}
+		target, r := findKeyedRemote(remotes, name)
+		if r == nil {
+			fmt.Printf("Error: Remote '%s' not found.\n", name)
+			return
+		}
+		if target.DestinationType() != config.TypeSift || target.OAuth2() {
+			fmt.Printf("Error: Remote '%s' does not authenticate with an API key.\n", name)
+			return
+		}
+		if target.KeyEnv != "" && key != "" {
+			fmt.Printf("Error: The key of '%s' is read from %s. Set the new key there and restart the service.\n", name, target.KeyEnv)
+			return
+		}
+		machineKey := resolveMachineKeyPath()
+		target.Destinations = nil // Resolved apart from the entries written back
+		if err := target.ResolveSecrets(machineKey); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+
+		if key != "" {
+			current := target.Key
+			if key == current {
+				fmt.Println("Error: The new key is the current key.")
+				return
+			}
+
+			// The new key is checked alone, with the connection settings the agent uses
+			var transport config.Transport
+			viper.Unmarshal(&transport)
+			target.InheritTransport(transport)
+			target.Key, target.SecondaryKey = key, ""
+			uploader, err := api.UploaderFor(target)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			fmt.Printf("Verifying new key against %s...\n", target.Endpoint)
+			err = uploader.Check(context.Background(), target)
+			var uerr *api.UploadError
+			errors.As(err, &uerr)
+
+			switch {
+			case err == nil:
+				fmt.Println("✅ New Key Accepted!")
+			case uerr != nil && uerr.Class == api.ClassAuth:
+				fmt.Printf("❌ New Key Rejected (Status: %d). The current key is unchanged.\n", uerr.Status)
+				return
+			case uerr != nil && uerr.Status != 0:
+				fmt.Printf("❌ Unexpected Response: %v\n", uerr)
+				return
+			default:
+				fmt.Printf("❌ Connection Failed: %v\n", err)
+				return
+			}
+			if at, ok := api.KeyExpiry(target, key); ok {
+				fmt.Printf(">>> WARNING: The server reports that the new key expires %s.\n", at.Local().Format(time.RFC1123))
+			}
+
+			// The old key keeps its form, a key from key_file is sealed as it
+			// moves into the config file
+			old := r.Key
+			if r.KeyFile != "" {
+				if old, err = config.Seal(current, machineKey); err != nil {
+					fmt.Printf("Failed to seal the previous key: %v\n", err)
+					return
+				}
+				if err := writeKeyFile(r.KeyFile, key); err != nil {
+					fmt.Printf("Failed to update %s: %v\n", r.KeyFile, err)
+					return
+				}
+			} else {
+				if encrypt || config.IsSealed(old) {
+					if key, err = config.Seal(key, machineKey); err != nil {
+						fmt.Printf("Failed to seal the new key: %v\n", err)
+						return
+					}
+				}
+				r.Key = key
+			}
+			r.SecondaryKey = old
+		}
+		if dropOld {
+			r.SecondaryKey = ""
+		}
+		if encrypt {
+			if err := r.SealSecrets(machineKey); err != nil {
+				fmt.Printf("Failed to seal secrets: %v\n", err)
+				return
+			}
+		}
+
+		viper.Set("remotes", remoteSettings(remotes))
+		if err := viper.WriteConfig(); err != nil {
+			fmt.Printf("Failed to save config: %v\n", err)
+			return
+		}
+
+		switch {
+		case key != "" && !dropOld:
+			fmt.Printf("Key of '%s' rotated. The previous key stays as secondary_key.\n", name)
+			fmt.Printf("Once it is revoked, run 'sift remote rotate-key %s --drop-old'.\n", name)
+		case key != "":
+			fmt.Printf("Key of '%s' replaced. The previous key was dropped.\n", name)
+		default:
+			fmt.Printf("Secondary key of '%s' dropped.\n", name)
+		}
+		fmt.Println("The running service picks up the change without a restart.")
+	},
+}
+
+// writeKeyFile replaces the contents of a key file, keeping it readable by
+// its owner only.
+func writeKeyFile(path string, key string) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(key+"\n"), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// findKeyedRemote finds a remote or a destination of one by the name shown in
+// 'sift remote ls'. It returns the effective settings and the entry to edit.
+func findKeyedRemote(remotes []config.RemoteConfig, name string) (config.RemoteConfig, *config.RemoteConfig) {
+	for i := range remotes {
+		if remotes[i].Name == name {
+			return remotes[i], &remotes[i]
+		}
+		for j, dest := range remotes[i].Targets() {
+			if dest.Name == name {
+				return dest, &remotes[i].Destinations[j]
+			}
+		}
+	}
+	return config.RemoteConfig{}, nil
+}
+
+func init() {
+	remoteRotateKeyCmd.Flags().String("key", "", "New API key, verified before it replaces the current one")
+	remoteRotateKeyCmd.Flags().Bool("drop-old", false, "Remove the secondary (previous) key")
+	remoteRotateKeyCmd.Flags().Bool("encrypt", false, "Seal secrets stored in clear text with this machine's key")
+	remoteCmd.AddCommand(remoteRotateKeyCmd)
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -28,6 +29,9 @@ import (
 	"github.com/cleverdata/sift-agent/internal/config"
 	"github.com/cleverdata/sift-agent/internal/core"
 	"github.com/cleverdata/sift-agent/internal/db"
+	"github.com/cleverdata/sift-agent/internal/metrics"
+	"github.com/cleverdata/sift-agent/internal/update"
+	"github.com/fsnotify/fsnotify"
 	"github.com/kardianos/service"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -42,22 +46,7 @@ func RunAgent() {
 	defer stop()
 
 	// 2. Initialize Database
-	var dbPath string
-	if viper.IsSet("db_path") {
-		dbPath = viper.GetString("db_path")
-	} else if localMode {
-		exePath, _ := os.Executable()
-		dbPath = filepath.Join(filepath.Dir(exePath), "state.db")
-	} else {
-		var dataDir string
-		if os.Getenv("OS") == "Windows_NT" {
-			dataDir = filepath.Join(os.Getenv("ProgramData"), "Sift")
-		} else {
-			dataDir = "/var/lib/sift-agent"
-		}
-		os.MkdirAll(dataDir, 0755)
-		dbPath = filepath.Join(dataDir, "state.db")
-	}
+	dbPath := resolveDBPath()
 
 	if err := db.Init(dbPath); err != nil {
 		log.Fatalf("Database initialization failed: %v", err)
@@ -78,6 +67,18 @@ func RunAgent() {
 		logger.Info(msg)
 	}
 
+	// A pending update is confirmed once every remote is up, see below
+	ready := make(chan struct{})
+	if exe, err := executablePath(); err == nil {
+		go update.ConfirmHealthy(ctx, exe, Version, ready)
+	}
+	if interval := viper.GetDuration("auto_update"); interval > 0 {
+		go autoUpdate(ctx, interval, logger)
+	}
+	if addr := viper.GetString("metrics_listen"); addr != "" {
+		go serveMetrics(ctx, addr, logger)
+	}
+
 	// 4. Load Remotes
 	var remotes []config.RemoteConfig
 	if err := viper.UnmarshalKey("remotes", &remotes); err != nil {
@@ -87,45 +88,198 @@ func RunAgent() {
 		return
 	}
 
+	// Top-level proxy and TLS settings apply to remotes that do not set their own
+	var transport config.Transport
+	viper.Unmarshal(&transport)
+	machineKey := resolveMachineKeyPath()
+	valid := remotes[:0]
+	watched := make(map[string]string)
+	for _, r := range remotes {
+		if err := r.ResolveSecrets(machineKey); err != nil {
+			if logger != nil {
+				logger.Errorf("[%s] Invalid configuration, remote disabled: %v", r.Name, err)
+			}
+			continue
+		}
+		r.InheritTransport(transport)
+		for i := range r.Destinations {
+			r.Destinations[i].InheritTransport(transport)
+		}
+		if err := validateRemote(r); err != nil {
+			if logger != nil {
+				logger.Errorf("[%s] Invalid configuration, remote disabled: %v", r.Name, err)
+			}
+			continue
+		}
+		// Remotes sharing a folder each archive its files, whichever finishes first
+		if other, ok := watched[filepath.Clean(r.Path)]; ok && logger != nil {
+			logger.Warningf("[%s] Watches the same path as remote %s. Use destinations to deliver one folder to several endpoints.", r.Name, other)
+		}
+		watched[filepath.Clean(r.Path)] = r.Name
+		valid = append(valid, r)
+	}
+	remotes = valid
+
 	if len(remotes) == 0 {
 		idle := "No remotes configured. Idling..."
 		fmt.Println(idle)
 		if logger != nil {
 			logger.Info(idle)
 		}
+		close(ready)
 		// Wait for signal even when idling to avoid deadlock
 		<-ctx.Done()
 		return
 	}
 
+	if viper.ConfigFileUsed() != "" {
+		reloadKeys(remotes, logger)
+	}
+
 	// 5. Start Pipeline
-	var wg sync.WaitGroup
+	// The agent is healthy once every watcher has run its first scan and every
+	// Sift server has accepted a heartbeat
+	hostname, _ := os.Hostname()
+	var wg, started sync.WaitGroup
 	for _, r := range remotes {
 		wg.Add(1)
+		started.Add(1)
+		if r.DestinationType() == config.TypeSift {
+			started.Add(1)
+		}
 		go func(remote config.RemoteConfig) {
 			defer wg.Done()
 			
-			// Heartbeat
-			go api.Pinger(ctx, remote, func(f string, v ...interface{}) {
-				if logger != nil {
-					logger.Warningf(f, v...)
+			// Heartbeat, for Sift servers only
+			if remote.DestinationType() == config.TypeSift {
+				status := func() api.Heartbeat {
+					hb := core.Health(remote)
+					hb.Version = Version
+					hb.Hostname = hostname
+					return hb
+				}
+				// Server-pushed overrides are recorded with the check URL as their source
+				onConfig := func(overrides map[string]string) config.RemoteConfig {
+					return core.ApplyOverrides(remote, overrides, remote.Endpoint+"/agent/check", logger)
 				}
-			})
+				go api.Pinger(ctx, remote, status, onConfig, sync.OnceFunc(started.Done), func(f string, v ...interface{}) {
+					if logger != nil {
+						logger.Warningf(f, v...)
+					}
+				})
+			} else if uploader, err := api.UploaderFor(remote); err == nil {
+				go api.WatchRecovery(ctx, remote, uploader)
+			}
+			for _, dest := range remote.Targets() {
+				if uploader, err := api.UploaderFor(dest); err == nil {
+					go api.WatchRecovery(ctx, dest, uploader)
+				}
+			}
 
 			// Watcher Engine
-			core.WatchRemote(ctx, remote, logger)
+			core.WatchRemote(ctx, remote, logger, started.Done)
 		}(r)
 	}
+	go func() {
+		started.Wait()
+		close(ready)
+	}()
 
 	// Wait for signal or all workers to stop
 	<-ctx.Done()
 	fmt.Println("Sift Agent shutting down...")
 	wg.Wait()
 }
+
+// serveMetrics serves Prometheus metrics on addr until ctx ends. The agent
+// runs on without them if the address cannot be bound.
+func serveMetrics(ctx context.Context, addr string, logger service.Logger) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		if logger != nil {
+			logger.Errorf("Metrics disabled: %v", err)
+		}
+		return
+	}
+	if logger != nil {
+		logger.Infof("Serving metrics on http://%s/metrics", ln.Addr())
+	}
+	if err := metrics.Serve(ctx, ln); err != nil && logger != nil {
+		logger.Errorf("Metrics listener failed: %v", err)
+	}
+}
+
+// reloadKeys watches the config file and hands changed API keys to the running
+// remotes, so 'sift remote rotate-key' takes effect without a restart. Other
+// settings still need one.
+func reloadKeys(remotes []config.RemoteConfig, logger service.Logger) {
+	var mu sync.Mutex
+	keys := make(map[string][2]string)
+	for _, r := range remotes {
+		for _, t := range append([]config.RemoteConfig{r}, r.Targets()...) {
+			keys[t.Name] = [2]string{t.Key, t.SecondaryKey}
+		}
+	}
+
+	viper.OnConfigChange(func(fsnotify.Event) {
+		var changed []config.RemoteConfig
+		if err := viper.UnmarshalKey("remotes", &changed); err != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, r := range changed {
+			if _, running := keys[r.Name]; !running {
+				continue
+			}
+			if err := r.ResolveSecrets(resolveMachineKeyPath()); err != nil {
+				if logger != nil {
+					logger.Warningf("[%s] Keys not reloaded: %v", r.Name, err)
+				}
+				continue
+			}
+			for _, t := range append([]config.RemoteConfig{r}, r.Targets()...) {
+				old, running := keys[t.Name]
+				updated := [2]string{t.Key, t.SecondaryKey}
+				if !running || t.Key == "" || old == updated {
+					continue
+				}
+				keys[t.Name] = updated
+				api.SetKeys(t.Name, t.Key, t.SecondaryKey)
+				if logger != nil {
+					logger.Infof("[%s] API key updated from the config file.", t.Name)
+				}
+			}
+		}
+	})
+	viper.WatchConfig()
+}
+
+// validateRemote checks the connection and destination settings of a remote
+// and of its additional destinations. A remote with any invalid destination is
+// disabled, as its files could never be archived.
+func validateRemote(r config.RemoteConfig) error {
+	for _, target := range append([]config.RemoteConfig{r}, r.Targets()...) {
+		if _, err := api.NewClient(target); err != nil {
+			return fmt.Errorf("connection settings of %s: %w", target.Name, err)
+		}
+		if _, err := api.UploaderFor(target); err != nil {
+			return fmt.Errorf("destination %s: %w", target.Name, err)
+		}
+	}
+	return nil
+}
+
 var runCmd = &cobra.Command{
 	Use:   "run",
 	Short: "Run the agent in the foreground (Internal Use)",
-	Long:  `Runs the watcher process directly. Usually invoked by the Windows Service.`,
+	Long: `Runs the watcher process directly. Usually invoked by the Windows Service.
+
+Config keys:
+  metrics_listen  Address to serve Prometheus metrics on, at /metrics, e.g.
+                  127.0.0.1:9464 (default off). Keep it on a local or
+                  otherwise protected interface, the endpoint has no
+                  authentication.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if service.Interactive() {
 			RunAgent()
@@ -0,0 +1,72 @@
+// Copyright 2026 CleverData
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var remoteSealCmd = &cobra.Command{
+	Use:   "seal",
+	Short: "Encrypt the secrets stored in clear text in the config file",
+	Long: `Seals every key, client secret, secret key, password and signing key still
+stored in clear text in the config file with machine.key, a key file next to
+the state database that only the service account and administrators can
+read. It is created on first use. On Linux and macOS the agent refuses a key
+file that group or others can read. Sealed secrets cannot be read on another
+machine or without the key file: keep a copy of the original secrets to set
+up a new machine. Keys given with key_env or key_file are left alone.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var remotes []config.RemoteConfig
+		if err := viper.UnmarshalKey("remotes", &remotes); err != nil || len(remotes) == 0 {
+			fmt.Println("No remotes configured.")
+			return
+		}
+
+		machineKey := resolveMachineKeyPath()
+		sealed := 0
+		for i := range remotes {
+			if !remotes[i].HasPlaintextSecrets() {
+				continue
+			}
+			if err := remotes[i].SealSecrets(machineKey); err != nil {
+				fmt.Printf("Failed to seal secrets of '%s': %v\n", remotes[i].Name, err)
+				return
+			}
+			fmt.Printf("Sealed secrets of '%s'.\n", remotes[i].Name)
+			sealed++
+		}
+		if sealed == 0 {
+			fmt.Println("No secrets in clear text.")
+			return
+		}
+
+		viper.Set("remotes", remoteSettings(remotes))
+		if err := viper.WriteConfig(); err != nil {
+			fmt.Printf("Failed to save config: %v\n", err)
+			return
+		}
+		fmt.Printf("Machine key: %s\n", machineKey)
+	},
+}
+
+func init() {
+	remoteCmd.AddCommand(remoteSealCmd)
+}
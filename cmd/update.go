@@ -0,0 +1,250 @@
+// Copyright 2026 CleverData
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/update"
+	"github.com/kardianos/service"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const defaultManifestURL = "https://sift.cleverdata.gr/agent/releases/manifest.json"
+
+var updateCmd = &cobra.Command{
+	Use:   "update",
+	Short: "Update the Sift Agent to the latest release",
+	Long: `Checks the release manifest, downloads the new binary, verifies its ed25519
+signature and swaps it in. If the agent is installed as a service it is
+restarted, and the previous binary is restored if the new version does not
+report healthy within --health-timeout. It reports healthy once its watchers
+are running and every Sift server has accepted a heartbeat. A build that fails its checks or is
+rolled back is not installed again by auto_update until the manifest offers
+another one.
+
+Config keys:
+  update_manifest    Release manifest URL. Point it at a local server for testing.
+  update_public_key  Base64 ed25519 signing key, if not built into the binary.
+  auto_update        Check interval for unattended updates, e.g. 24h (default off).`,
+	Example: `  sift update --check
+  sift update --manifest http://localhost:8000/manifest.json
+  sift update --rollback`,
+	Run: func(cmd *cobra.Command, args []string) {
+		checkOnly, _ := cmd.Flags().GetBool("check")
+		rollback, _ := cmd.Flags().GetBool("rollback")
+		manifestURL, _ := cmd.Flags().GetString("manifest")
+		timeout, _ := cmd.Flags().GetDuration("health-timeout")
+		if manifestURL == "" {
+			manifestURL = updateManifestURL()
+		}
+
+		exe, err := executablePath()
+		if err != nil {
+			fmt.Printf("Error: Could not determine executable path: %v\n", err)
+			os.Exit(1)
+		}
+
+		ctx := context.Background()
+		if rollback {
+			if err := update.Rollback(exe, Version); err != nil {
+				fmt.Printf("❌ Rollback failed: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Println("✅ Previous version restored.")
+			restartIfInstalled()
+			return
+		}
+
+		if err := runUpdate(ctx, exe, manifestURL, checkOnly, timeout); err != nil {
+			fmt.Printf("❌ Update failed: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func runUpdate(ctx context.Context, exe string, manifestURL string, checkOnly bool, timeout time.Duration) error {
+	fmt.Printf("Checking %s...\n", manifestURL)
+	manifest, build, err := update.FetchManifest(ctx, manifestURL)
+	if err != nil {
+		return err
+	}
+	if !update.Newer(manifest.Version, Version) {
+		fmt.Printf("Sift Agent v%s is up to date.\n", Version)
+		return nil
+	}
+	fmt.Printf("New version available: v%s -> v%s\n", Version, manifest.Version)
+	if checkOnly {
+		return nil
+	}
+
+	fmt.Printf("Downloading %s...\n", build.URL)
+	staged, err := update.Download(ctx, exe, manifest.Version, build, updatePublicKey())
+	if err != nil {
+		return err
+	}
+	fmt.Println("✅ Signature verified.")
+
+	if err := update.SmokeTest(ctx, staged, manifest.Version); err != nil {
+		os.Remove(staged)
+		update.Reject(exe, manifest.Version, build.SHA256)
+		return err
+	}
+
+	s, installed := installedService()
+	if installed {
+		if err := update.BeginProbation(exe, Version, manifest.Version); err != nil {
+			os.Remove(staged)
+			return err
+		}
+	}
+	if err := update.Swap(exe, staged); err != nil {
+		return err
+	}
+	fmt.Printf("Installed v%s.\n", manifest.Version)
+
+	if !installed {
+		fmt.Println("Restart the agent to run the new version. Use 'sift update --rollback' to undo.")
+		return nil
+	}
+
+	fmt.Println("Restarting service...")
+	if err := s.Restart(); err == nil {
+		fmt.Printf("Waiting up to %s for v%s to report healthy...\n", timeout, manifest.Version)
+		if update.WaitHealthy(ctx, exe, manifest.Version, timeout) {
+			update.Finish(exe)
+			fmt.Printf("✅ Updated to v%s.\n", manifest.Version)
+			return nil
+		}
+	} else {
+		fmt.Printf("Failed to restart: %v\n", err)
+	}
+
+	fmt.Println("⚠️  New version failed its health check. Rolling back...")
+	if err := update.Rollback(exe, manifest.Version); err != nil {
+		return fmt.Errorf("rollback failed: %w", err)
+	}
+	if err := s.Restart(); err != nil {
+		return fmt.Errorf("restored v%s but failed to restart: %w", Version, err)
+	}
+	return fmt.Errorf("v%s failed its health check, v%s restored", manifest.Version, Version)
+}
+
+// autoUpdate checks for a new release every interval and hands it to a
+// detached 'sift update', which restarts the service and outlives it. Builds
+// that were rejected or rolled back are skipped until the manifest changes.
+func autoUpdate(ctx context.Context, interval time.Duration, logger service.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	skipped := ""
+
+	for {
+		select {
+		case <-ticker.C:
+			manifest, build, err := update.FetchManifest(ctx, updateManifestURL())
+			if err != nil {
+				if logger != nil {
+					logger.Warningf("Auto-update check failed: %v", err)
+				}
+				continue
+			}
+			if !update.Newer(manifest.Version, Version) {
+				continue
+			}
+
+			exe, err := executablePath()
+			if err != nil {
+				continue
+			}
+			if update.Rejected(exe, manifest, build) {
+				if skipped != manifest.Version && logger != nil {
+					logger.Warningf("Auto-update: v%s was rolled back or failed to install before. Skipping it until the manifest changes.", manifest.Version)
+				}
+				skipped = manifest.Version
+				continue
+			}
+			args := []string{"update"}
+			if localMode {
+				args = append(args, "--local")
+			} else if cfg := viper.ConfigFileUsed(); cfg != "" {
+				args = append(args, "--config", cfg)
+			}
+			if logger != nil {
+				logger.Infof("Auto-update: v%s available. Starting updater.", manifest.Version)
+			}
+			if err := update.Spawn(exe, args...); err != nil && logger != nil {
+				logger.Errorf("Auto-update failed to start: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func updateManifestURL() string {
+	if viper.IsSet("update_manifest") {
+		return viper.GetString("update_manifest")
+	}
+	return defaultManifestURL
+}
+
+func updatePublicKey() string {
+	if viper.IsSet("update_public_key") {
+		return viper.GetString("update_public_key")
+	}
+	return update.PublicKey
+}
+
+func executablePath() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+// installedService returns the agent's service if it is installed.
+func installedService() (service.Service, bool) {
+	s, err := service.New(&program{}, &service.Config{Name: "SiftAgent"})
+	if err != nil {
+		return nil, false
+	}
+	if _, err := s.Status(); err != nil {
+		return nil, false
+	}
+	return s, true
+}
+
+func restartIfInstalled() {
+	if s, ok := installedService(); ok {
+		fmt.Println("Restarting service...")
+		if err := s.Restart(); err != nil {
+			fmt.Printf("Failed to restart: %v\n", err)
+		}
+	}
+}
+
+func init() {
+	updateCmd.Flags().Bool("check", false, "Only report whether an update is available")
+	updateCmd.Flags().Bool("rollback", false, "Restore the version replaced by the last update")
+	updateCmd.Flags().String("manifest", "", "Release manifest URL (overrides update_manifest)")
+	updateCmd.Flags().Duration("health-timeout", 2*time.Minute, "How long the updated service has to report healthy before rolling back")
+	rootCmd.AddCommand(updateCmd)
+}
@@ -4,35 +4,137 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/cleverdata/sift-agent/internal/metrics"
 	"github.com/go-resty/resty/v2"
 )
 
-func Pinger(ctx context.Context, remote config.RemoteConfig, logger func(string, ...interface{})) {
-	client := resty.New()
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
+// Heartbeat is the agent status reported to the server with every check, so
+// admins can see which agents are lagging.
+type Heartbeat struct {
+	Version     string     `json:"version"`
+	Hostname    string     `json:"hostname"`
+	Remote      string     `json:"remote"`
+	Mode        string     `json:"mode"`         // "fsnotify" or "polling"
+	QueueDepth  int        `json:"queue_depth"`  // Files settling or waiting for a worker
+	InFlight    int        `json:"in_flight"`    // Files holding a worker slot
+	FailedFiles int        `json:"failed_files"` // Files rejected, corrupt or still failing
+	LastUpload  *time.Time `json:"last_upload_at,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// Pinger posts a Heartbeat to the remote's endpoint every heartbeat_interval
+// (default 1m) and records the capabilities the server advertises in reply.
+// Servers that do not accept the POST (404/405) get a bare GET instead. Setting
+// overrides in the reply are handed to onConfig, which returns the remote's
+// effective configuration. onOK is called after every accepted heartbeat.
+//
+// Results feed the endpoint's circuit breaker: failures count toward opening
+// it, and the first success after it opened lets a trial upload through. While
+// the breaker is open the heartbeat runs more often so recovery is noticed
+// quickly.
+func Pinger(ctx context.Context, remote config.RemoteConfig, status func() Heartbeat,
+	onConfig func(map[string]string) config.RemoteConfig, onOK func(), logger func(string, ...interface{})) {
+
+	transport, err := transportFor(remote)
+	if err != nil {
+		if logger != nil {
+			logger("[%s] Heartbeat disabled: %v", remote.Name, err)
+		}
+		return
+	}
+	client := withAuth(resty.New().SetTransport(transport).SetPreRequestHook(signed(remote, nil)), remote)
+	b := breakerFor(remote.Endpoint)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	interval := heartbeatInterval(remote)
+	legacy := false
+
+	send := func() (*resty.Response, error) {
+		if legacy || status == nil {
+			return client.R().SetContext(ctx).Get(remote.Endpoint + "/agent/check")
+		}
+		resp, err := client.R().SetContext(ctx).SetBody(status()).Post(remote.Endpoint + "/agent/check")
+		if err == nil && (resp.StatusCode() == 404 || resp.StatusCode() == 405) {
+			legacy = true
+			if logger != nil {
+				logger("[%s] Server does not accept heartbeat reports. Falling back to plain checks.", remote.Name)
+			}
+			return client.R().SetContext(ctx).Get(remote.Endpoint + "/agent/check")
+		}
+		return resp, err
+	}
+
+	check := func() {
+		resp, err := send()
+		if err == nil && resp.StatusCode() == 401 && (remote.OAuth2() || keyRingFor(remote).hasFallback()) {
+			// The token was dropped or the other key is up, try once more
+			resp, err = send()
+		}
+		logKeyNotices(remote, logger)
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// Rejected client credentials say nothing about the endpoint
+			var uerr *UploadError
+			if !errors.As(err, &uerr) || uerr.Class != ClassAuth {
+				b.failure()
+			}
+			metrics.Heartbeats.Inc(remote.Name, "failed")
+			metrics.HeartbeatUp.Set(0, remote.Name)
+			if logger != nil {
+				logger("[%s] Heartbeat failed: %s", remote.Name, describeError(err))
+			}
+		} else if resp.StatusCode() != 200 {
+			if resp.StatusCode() >= 500 {
+				b.failure()
+			}
+			metrics.Heartbeats.Inc(remote.Name, "rejected")
+			metrics.HeartbeatUp.Set(0, remote.Name)
+			if logger != nil {
+				logger("[%s] Heartbeat rejected: Status %d", remote.Name, resp.StatusCode())
+			}
+		} else {
+			metrics.Heartbeats.Inc(remote.Name, "ok")
+			metrics.HeartbeatUp.Set(1, remote.Name)
+			metrics.HeartbeatLastSuccess.Set(float64(time.Now().Unix()), remote.Name)
+			recordCapabilities(remote.Endpoint, resp.Body())
+			if b.recovered() && logger != nil {
+				logger("[%s] Endpoint reachable again. Resuming uploads with a trial request.", remote.Name)
+			}
+			if overrides, ok := parseOverrides(resp.Body()); ok && onConfig != nil {
+				interval = heartbeatInterval(onConfig(overrides))
+			}
+			if onOK != nil {
+				onOK()
+			}
+		}
+	}
 
 	for {
 		select {
-		case <-ticker.C:
-			resp, err := client.R().
-				SetHeader("Authorization", "Bearer "+remote.Key).
-				Get(remote.Endpoint + "/agent/check")
-
-			if err != nil {
-				if logger != nil {
-					logger("[%s] Heartbeat failed: %v", remote.Name, err)
-				}
-			} else if resp.StatusCode() != 200 {
-				if logger != nil {
-					logger("[%s] Heartbeat rejected: Status %d", remote.Name, resp.StatusCode())
-				}
+		case <-timer.C:
+			// The first check runs immediately so capabilities are known before the first upload
+			check()
+			if BreakerState(remote.Endpoint) == BreakerOpen {
+				timer.Reset(min(interval, 15*time.Second))
+			} else {
+				timer.Reset(interval)
 			}
 		case <-ctx.Done():
 			return
@@ -40,45 +142,385 @@ func Pinger(ctx context.Context, remote config.RemoteConfig, logger func(string,
 	}
 }
 
-func UploadFile(ctx context.Context, remote config.RemoteConfig, filePath string, modTime int64,
-	onSuccess func(string, string, int64), onError func(string), logger func(string, ...interface{})) {
+func heartbeatInterval(remote config.RemoteConfig) time.Duration {
+	interval, err := time.ParseDuration(remote.HeartbeatInterval)
+	if err != nil || interval <= 0 {
+		return 1 * time.Minute
+	}
+	return interval
+}
 
-	client := resty.New()
+// FileExists asks the server whether a document with the given SHA-256 is
+// already stored for the tenant owning the API key.
+func FileExists(ctx context.Context, client *resty.Client, remote config.RemoteConfig, hash string) (bool, error) {
+	var result struct {
+		Exists bool `json:"exists"`
+	}
 
-	f, err := os.Open(filePath)
+	resp, err := client.R().
+		SetContext(ctx).
+		SetQueryParam("sha256", hash).
+		SetResult(&result).
+		Get(remote.Endpoint + "/agent/exists")
 	if err != nil {
+		return false, err
+	}
+
+	switch resp.StatusCode() {
+	case 200:
+		return result.Exists, nil
+	case 404:
+		return false, nil
+	default:
+		return false, fmt.Errorf("existence check failed: status %d", resp.StatusCode())
+	}
+}
+
+// Receipt describes what the server reported for an accepted upload.
+type Receipt struct {
+	DocumentID    string `json:"document_id"`
+	SHA256        string `json:"sha256"`
+	Size          int64  `json:"size"`
+	Status        string `json:"status"`
+	AlreadyStored bool   `json:"-"` // Transfer skipped, server matched the hash
+	Encoding      string `json:"-"` // Content-Encoding used for the transfer, if any
+	RawBytes      int64  `json:"-"` // Body size before compression
+	WireBytes     int64  `json:"-"` // Body size actually sent
+}
+
+// ErrNotReady is returned by VerifyUpload while the server is still ingesting.
+var ErrNotReady = errors.New("document not yet ingested")
+
+// UploadFile sends the file, retrying with backoff as the remote's retry policy
+// allows. On failure onError receives an *UploadError so the caller can decide
+// whether to quarantine the file, pause the remote or try again later.
+func UploadFile(ctx context.Context, remote config.RemoteConfig, filePath string, modTime int64,
+	onSuccess func(string, string, int64, Receipt), onError func(string, error), logger func(string, ...interface{})) {
+
+	client, err := clientFor(remote)
+	if err != nil {
+		if logger != nil {
+			logger("[%s] Cannot upload %s: %v", remote.Name, filepath.Base(filePath), err)
+		}
+		failLocal(filePath, err, onError)
 		return
 	}
+	fileName := filepath.Base(filePath)
 
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, f); err != nil {
-		f.Close()
+	info, err := os.Stat(filePath)
+	if err != nil {
+		failLocal(filePath, err, onError)
 		return
 	}
-	localHash := hex.EncodeToString(hasher.Sum(nil))
-	f.Close()
 
-	for i := 0; i < 3; i++ {
-		resp, err := client.R().
-			SetContext(ctx).
-			SetHeader("Authorization", "Bearer "+remote.Key).
-			SetFile("file", filePath).
-			Post(fmt.Sprintf("%s/agent/upload", remote.Endpoint))
+	// Encrypted files go out in one request per attempt, each under a data key
+	// of its own, and are not looked up, which would reveal their plaintext hash
+	encrypts := Encrypts(remote)
+	if encrypts {
+		if _, _, err := loadRecipient(remote.EncryptTo); err != nil {
+			if logger != nil {
+				logger("[%s] Cannot encrypt %s: %v", remote.Name, fileName, err)
+			}
+			failLocal(filePath, err, onError)
+			return
+		}
+	}
+
+	threshold := chunkThreshold(remote)
+	resumable := !encrypts && threshold > 0 && info.Size() >= threshold && HasCapability(remote.Endpoint, CapResumable)
+	lookup := !encrypts && HasCapability(remote.Endpoint, CapHashLookup)
+
+	// The digest is only computed ahead of the transfer when something needs it
+	// before sending. Otherwise the file is hashed while it streams. A hash the
+	// caller computed stands in for sha256-only digests. Encrypted files are
+	// digested by sendSealed, within each attempt.
+	var known string
+	if !encrypts {
+		known = contentHash(ctx)
+	}
+	var digest uploadDigest
+	var fixedBody *multipartBody
+	switch {
+	case encrypts:
+	case remote.ContentMD5 || signs(remote) || ((resumable || lookup) && known == ""):
+		digest, fixedBody, err = digestFile(filePath, fileName, nil, remote.ContentMD5, signs(remote))
+		if err != nil {
+			failLocal(filePath, err, onError)
+			return
+		}
+	case known != "":
+		digest = uploadDigest{sha256: known, size: info.Size()}
+	}
 
-		if err == nil && resp.StatusCode() >= 200 && resp.StatusCode() < 300 {
+	if lookup {
+		exists, err := FileExists(ctx, client, remote, digest.sha256)
+		if err != nil {
+			if logger != nil {
+				logger("[%s] Existence check failed for %s, uploading anyway: %v", remote.Name, fileName, err)
+			}
+		} else if exists {
+			if logger != nil {
+				logger("[%s] Server already has %s (sha256 %s). Skipping transfer.", remote.Name, fileName, digest.sha256)
+			}
 			if onSuccess != nil {
-				onSuccess(filePath, localHash, modTime)
+				onSuccess(filePath, digest.sha256, modTime, Receipt{AlreadyStored: true})
 			}
 			return
 		}
+	}
 
-		select {
-		case <-time.After(2 * time.Second):
-		case <-ctx.Done():
+	if resumable {
+		receipt, err := uploadResumable(ctx, client, remote, filePath, digest, modTime, logger)
+		if tokenRenewable(remote, err) {
+			// The session survives, so the new token picks up where the old one stopped
+			receipt, err = uploadResumable(ctx, client, remote, filePath, digest, modTime, logger)
+		}
+		if err == nil && receipt.SHA256 != "" && !strings.EqualFold(receipt.SHA256, digest.sha256) {
+			err = &UploadError{Class: ClassTransient, Err: fmt.Errorf("digest mismatch: sent sha256 %s, server received %s", digest.sha256, receipt.SHA256)}
+		}
+		if err == nil {
+			if onSuccess != nil {
+				onSuccess(filePath, digest.sha256, modTime, receipt)
+			}
+			return
+		}
+		if ctx.Err() != nil {
 			return
 		}
+		if logger != nil {
+			logger("[%s] Resumable upload of %s failed: %v", remote.Name, fileName, err)
+		}
+		if onError != nil {
+			onError(filePath, Classify(err))
+		}
+		return
+	}
+
+	var sent string
+	var receipt Receipt
+	ok, lastErr := withRetries(ctx, remote, fileName, logger, func() error {
+		var err error
+		if encrypts {
+			sent, receipt, err = sendSealed(ctx, client, remote, filePath, modTime)
+		} else {
+			sent, receipt, err = sendFile(ctx, client, remote, filePath, modTime, digest, fixedBody, nil)
+		}
+		return err
+	})
+	if ok {
+		if onSuccess != nil {
+			onSuccess(filePath, sent, modTime, receipt)
+		}
+		return
+	}
+	if onError != nil && lastErr != nil {
+		onError(filePath, lastErr)
+	}
+}
+
+// sendSealed performs a single upload attempt of an encrypted file. Segment
+// nonces are fixed by position, so each attempt seals under a new data key: a
+// file that changed between attempts would otherwise send different
+// plaintexts under the same key and nonces. A digest the request needs up
+// front is computed under the same key, within the attempt.
+func sendSealed(ctx context.Context, client *resty.Client, remote config.RemoteConfig, filePath string, modTime int64) (string, Receipt, error) {
+	env, err := newEnvelope(remote)
+	if err != nil {
+		return "", Receipt{}, err
+	}
+	var digest uploadDigest
+	var fixedBody *multipartBody
+	if remote.ContentMD5 || signs(remote) {
+		digest, fixedBody, err = digestFile(filePath, filepath.Base(filePath), env, remote.ContentMD5, signs(remote))
+		if err != nil {
+			return "", Receipt{}, err
+		}
+	}
+	return sendFile(ctx, client, remote, filePath, modTime, digest, fixedBody, env)
+}
+
+// sendFile performs a single upload attempt, reading the file once. It returns
+// the SHA-256 of the bytes actually sent, or with env of the plaintext they
+// were encrypted from. digest and fixedBody are set only when the file was
+// hashed ahead of time.
+func sendFile(ctx context.Context, client *resty.Client, remote config.RemoteConfig, filePath string, modTime int64,
+	digest uploadDigest, fixedBody *multipartBody, env *envelope) (string, Receipt, error) {
+
+	f, src, body, err := openUpload(filePath, filepath.Base(filePath), env)
+	if err != nil {
+		return "", Receipt{}, err
+	}
+	defer f.Close()
+	if fixedBody != nil {
+		body = fixedBody
+	}
+
+	size := digest.size
+	if digest.sha256 == "" {
+		fi, err := f.Stat()
+		if err != nil {
+			return "", Receipt{}, err
+		}
+		size = fi.Size()
+		if env != nil {
+			size = SealedSize(size)
+		}
 	}
-	if onError != nil {
-		onError(filePath)
+
+	stream := newUploadStream(body, src)
+	var reqBody io.Reader = stream
+	var wire int64
+
+	encoding := chooseEncoding(remote, filepath.Base(filePath), body.fileType)
+	if encoding != "" {
+		compressed, err := compressStream(stream, encoding, &wire)
+		if err != nil {
+			return "", Receipt{}, err
+		}
+		defer compressed.Close()
+		reqBody = compressed
+	}
+
+	idle := idleTimeout(remote)
+	reqCtx, stop := watchIdle(ctx, reqBody, idle)
+	defer stop()
+
+	req := client.R().
+		SetContext(reqCtx).
+		SetHeader("Content-Type", body.contentType).
+		SetHeader(HeaderContentSize, strconv.FormatInt(size, 10)).
+		SetHeader(HeaderModTime, time.Unix(0, modTime).UTC().Format(time.RFC3339Nano))
+	if encoding != "" {
+		// Encoded length is unknown up front, so the body goes out chunked
+		req.SetHeader("Content-Encoding", encoding)
+	} else {
+		req.SetHeader("Content-Length", strconv.FormatInt(body.length(size), 10))
+	}
+	if digest.sha256 != "" {
+		req.SetHeader(HeaderContentSHA256, digest.sha256)
+	}
+	if digest.md5 != "" {
+		req.SetHeader("Content-MD5", digest.md5)
+	}
+	if digest.body != "" {
+		req.SetHeader(HeaderBodySHA256, digest.body)
+	}
+	if env != nil {
+		req.SetHeaders(env.headers)
+	}
+
+	resp, err := req.Post(fmt.Sprintf("%s/agent/upload", remote.Endpoint))
+	if err != nil {
+		return "", Receipt{}, idleError(reqCtx, err, idle)
+	}
+	if resp.StatusCode() < 200 || resp.StatusCode() >= 300 {
+		return "", Receipt{}, statusError(resp, "upload rejected")
+	}
+
+	sent := stream.Sum()
+	if digest.sha256 != "" && sent != digest.sha256 {
+		return "", Receipt{}, fmt.Errorf("file changed while uploading: hashed sha256 %s, sent %s", digest.sha256, sent)
+	}
+
+	var receipt Receipt
+	json.Unmarshal(resp.Body(), &receipt) // Older servers return no body
+
+	echoed := resp.Header().Get(HeaderContentSHA256)
+	if echoed == "" {
+		echoed = receipt.SHA256
+	}
+	if echoed != "" && !strings.EqualFold(echoed, sent) {
+		return "", Receipt{}, fmt.Errorf("digest mismatch: sent sha256 %s, server received %s", sent, echoed)
+	}
+
+	if encoding != "" {
+		receipt.Encoding = encoding
+		receipt.RawBytes = body.length(stream.size)
+		receipt.WireBytes = wire
+		recordCompression(remote, encoding, receipt.RawBytes, receipt.WireBytes)
+	}
+	if sealed, ok := src.(*sealingReader); ok {
+		return sealed.PlainSum(), receipt, nil
+	}
+	return sent, receipt, nil
+}
+
+// VerifyUpload fetches the server's view of an uploaded document so the caller
+// can compare the ingested hash and size against the local file.
+func VerifyUpload(ctx context.Context, remote config.RemoteConfig, documentID string) (Receipt, error) {
+	client, err := clientFor(remote)
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	var receipt Receipt
+	resp, err := client.R().
+		SetContext(ctx).
+		SetResult(&receipt).
+		Get(fmt.Sprintf("%s/agent/documents/%s", remote.Endpoint, url.PathEscape(documentID)))
+	if err != nil {
+		return Receipt{}, err
+	}
+
+	switch {
+	case resp.StatusCode() == 202 || (resp.StatusCode() == 200 && receipt.Status == "processing"):
+		return Receipt{}, ErrNotReady
+	case resp.StatusCode() == 200:
+		return receipt, nil
+	default:
+		return Receipt{}, fmt.Errorf("verification failed: status %d", resp.StatusCode())
+	}
+}
+
+// UploadReference registers filePath with the server as a duplicate of content
+// it already holds, identified by hash, without sending the file body.
+func UploadReference(ctx context.Context, remote config.RemoteConfig, filePath string, hash string, modTime int64) error {
+	client, err := clientFor(remote)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.R().
+		SetContext(ctx).
+		SetBody(map[string]interface{}{
+			"filename": filepath.Base(filePath),
+			"sha256":   hash,
+			"mod_time": modTime,
+		}).
+		Post(fmt.Sprintf("%s/agent/reference", remote.Endpoint))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() < 200 || resp.StatusCode() >= 300 {
+		return fmt.Errorf("reference rejected: status %d", resp.StatusCode())
+	}
+	return nil
+}
+
+type contentHashKey struct{}
+
+// WithContentHash attaches the SHA-256 the caller already computed for a file,
+// e.g. for dedup, to an upload context. The upload uses it instead of reading
+// the file an extra time, and fails as changed if the content sent differs.
+func WithContentHash(ctx context.Context, hash string) context.Context {
+	return context.WithValue(ctx, contentHashKey{}, hash)
+}
+
+func contentHash(ctx context.Context) string {
+	hash, _ := ctx.Value(contentHashKey{}).(string)
+	return hash
+}
+
+func HashFile(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
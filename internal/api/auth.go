@@ -0,0 +1,323 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/go-resty/resty/v2"
+)
+
+// Requests to a Sift server carry the remote's key as a bearer token, or with
+// auth: oauth2 an access token obtained from token_url with the OAuth2
+// client-credentials grant (RFC 6749 4.4). Tokens are cached per token URL and
+// client until shortly before they expire. A token the server rejects with 401
+// is dropped, and the request is retried once with a new one.
+//
+// A remote may also have a secondary_key, used while a key is being rotated.
+// When the server rejects the key in use with 401, the agent switches to the
+// other one and retries once. The server announces a key that is about to
+// expire with the X-Sift-Key-Expires response header (RFC 3339 or HTTP date).
+const (
+	defaultTokenLifetime = 5 * time.Minute // When the token response has no expires_in
+	maxRefreshMargin     = time.Minute     // Tokens are renewed this long before expiry, or at 80% of a shorter lifetime
+	tokenRequestTimeout  = 30 * time.Second
+	keyExpiryWarnEvery   = 24 * time.Hour // Repeat interval of the key expiry warning
+)
+
+var errTokenRejected = errors.New("token request rejected")
+
+type tokenSource struct {
+	mu        sync.Mutex
+	token     string
+	refreshAt time.Time
+}
+
+var (
+	tokensMu sync.Mutex
+	tokens   = make(map[string]*tokenSource)
+)
+
+func tokenSourceFor(remote config.RemoteConfig) *tokenSource {
+	key := remote.TokenURL + "\x00" + remote.ClientID + "\x00" + strings.Join(remote.Scopes, " ")
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	s, ok := tokens[key]
+	if !ok {
+		s = &tokenSource{}
+		tokens[key] = s
+	}
+	return s
+}
+
+// keyRing holds the primary and secondary key of a remote and which of them
+// the server currently accepts.
+type keyRing struct {
+	mu       sync.Mutex
+	keys     [2]string // Primary, secondary
+	active   int
+	switched bool                 // Switched keys since the last notice
+	expires  map[string]time.Time // Expiry announced by the server, per key
+	warned   time.Time
+}
+
+var (
+	keyRingsMu sync.Mutex
+	keyRings   = make(map[string]*keyRing)
+)
+
+// keyRingFor returns the keys of the remote, taken from its configuration on
+// first use and replaced by SetKeys.
+func keyRingFor(remote config.RemoteConfig) *keyRing {
+	keyRingsMu.Lock()
+	defer keyRingsMu.Unlock()
+	r, ok := keyRings[remote.Name]
+	if !ok {
+		r = &keyRing{keys: [2]string{remote.Key, remote.SecondaryKey}, expires: make(map[string]time.Time)}
+		keyRings[remote.Name] = r
+	}
+	return r
+}
+
+// SetKeys replaces the keys of a running remote, e.g. after a rotation. The
+// new primary key is used from the next request on.
+func SetKeys(name string, primary string, secondary string) {
+	r := keyRingFor(config.RemoteConfig{Name: name})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = [2]string{primary, secondary}
+	r.active = 0
+	r.switched = false
+	r.warned = time.Time{}
+}
+
+func (r *keyRing) current() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.keys[r.active]
+}
+
+var keyLabels = [2]string{"primary", "secondary"}
+
+func (r *keyRing) hasFallback() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.keys[0] != "" && r.keys[1] != ""
+}
+
+// expiring records the expiry the server announced for key, or forgets it
+// when the server no longer announces one.
+func (r *keyRing) expiring(key string, at time.Time, announced bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if announced {
+		r.expires[key] = at
+	} else {
+		delete(r.expires, key)
+	}
+}
+
+// reject switches to the other key after the server refused key, unless the
+// ring already moved on or has no other key.
+func (r *keyRing) reject(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	other := 1 - r.active
+	if r.keys[r.active] == key && r.keys[other] != "" {
+		r.active = other
+		r.switched = true
+	}
+}
+
+// bearerToken returns the credential to send to the remote: its active key,
+// or a current OAuth2 access token.
+func bearerToken(ctx context.Context, remote config.RemoteConfig) (string, error) {
+	if !remote.OAuth2() {
+		return keyRingFor(remote).current(), nil
+	}
+	s := tokenSourceFor(remote)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Now().Before(s.refreshAt) {
+		return s.token, nil
+	}
+	token, lifetime, err := fetchToken(ctx, remote)
+	if err != nil {
+		return "", err
+	}
+	s.token = token
+	s.refreshAt = time.Now().Add(lifetime - min(lifetime/5, maxRefreshMargin))
+	return token, nil
+}
+
+// dropToken forgets token after the server rejected it, unless it was
+// already replaced.
+func dropToken(remote config.RemoteConfig, token string) {
+	s := tokenSourceFor(remote)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == token {
+		s.token = ""
+	}
+}
+
+// fetchToken requests an access token with the client-credentials grant. The
+// client authenticates with HTTP Basic, as RFC 6749 2.3.1 recommends.
+func fetchToken(ctx context.Context, remote config.RemoteConfig) (string, time.Duration, error) {
+	transport, err := tokenTransportFor(remote)
+	if err != nil {
+		return "", 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, tokenRequestTimeout)
+	defer cancel()
+
+	form := map[string]string{"grant_type": "client_credentials"}
+	if len(remote.Scopes) > 0 {
+		form["scope"] = strings.Join(remote.Scopes, " ")
+	}
+	basic := base64.StdEncoding.EncodeToString([]byte(url.QueryEscape(remote.ClientID) + ":" + url.QueryEscape(remote.ClientSecret)))
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		TokenType        string `json:"token_type"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	resp, err := resty.New().SetTransport(transport).R().
+		SetContext(ctx).
+		SetHeader("Authorization", "Basic "+basic).
+		SetHeader("Accept", "application/json").
+		SetFormData(form).
+		Post(remote.TokenURL)
+	if err != nil {
+		return "", 0, fmt.Errorf("token request failed: %w", err)
+	}
+	json.Unmarshal(resp.Body(), &result)
+
+	code := resp.StatusCode()
+	switch {
+	case code == 429 || code >= 500:
+		return "", 0, statusError(resp, "token request failed")
+	case code != 200:
+		// invalid_client and friends: the credentials are wrong, not the file
+		reason := resp.Status()
+		if result.Error != "" {
+			reason = strings.TrimSpace(result.Error + " " + result.ErrorDescription)
+		}
+		return "", 0, &UploadError{Class: ClassAuth, Status: code, Err: fmt.Errorf("%w: %s", errTokenRejected, reason)}
+	case result.AccessToken == "":
+		return "", 0, errors.New("token request failed: no access_token in response")
+	case result.TokenType != "" && !strings.EqualFold(result.TokenType, "bearer"):
+		return "", 0, fmt.Errorf("token request failed: unsupported token type %q", result.TokenType)
+	}
+
+	lifetime := time.Duration(result.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = defaultTokenLifetime
+	}
+	return result.AccessToken, lifetime, nil
+}
+
+// withAuth sets the Authorization header on every request of client. Tokens
+// the server answers with 401 are dropped, or for keys the other key is
+// tried, and announced key expiries are recorded.
+func withAuth(client *resty.Client, remote config.RemoteConfig) *resty.Client {
+	return client.
+		OnBeforeRequest(func(_ *resty.Client, req *resty.Request) error {
+			token, err := bearerToken(req.Context(), remote)
+			if err != nil {
+				return err
+			}
+			req.SetHeader("Authorization", "Bearer "+token)
+			return nil
+		}).
+		OnAfterResponse(func(_ *resty.Client, resp *resty.Response) error {
+			sent := strings.TrimPrefix(resp.Request.Header.Get("Authorization"), "Bearer ")
+			switch {
+			case resp.StatusCode() == 401 && remote.OAuth2():
+				dropToken(remote, sent)
+			case resp.StatusCode() == 401:
+				keyRingFor(remote).reject(sent)
+			case !remote.OAuth2() && resp.IsSuccess():
+				at, ok := parseKeyExpiry(resp.Header().Get("X-Sift-Key-Expires"))
+				keyRingFor(remote).expiring(sent, at, ok)
+			}
+			return nil
+		})
+}
+
+// parseKeyExpiry reads an X-Sift-Key-Expires header value.
+func parseKeyExpiry(v string) (time.Time, bool) {
+	if v == "" {
+		return time.Time{}, false
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// tokenRenewable reports whether err is the server rejecting an OAuth2 access
+// token or a key with a fallback, which withAuth has dropped or switched so
+// that a retry uses a new token or the other key.
+func tokenRenewable(remote config.RemoteConfig, err error) bool {
+	var uerr *UploadError
+	if !errors.As(err, &uerr) || uerr.Status != 401 || errors.Is(err, errTokenRejected) {
+		return false
+	}
+	return remote.OAuth2() || keyRingFor(remote).hasFallback()
+}
+
+// KeyExpiry returns the expiry the server announced for key, if any.
+func KeyExpiry(remote config.RemoteConfig, key string) (time.Time, bool) {
+	r := keyRingFor(remote)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	at, ok := r.expires[key]
+	return at, ok
+}
+
+// logKeyNotices logs a switch to the other key, and at most once a day an
+// expiry the server announced for the primary key.
+func logKeyNotices(remote config.RemoteConfig, logger func(string, ...interface{})) {
+	if logger == nil || remote.OAuth2() {
+		return
+	}
+	r := keyRingFor(remote)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.switched {
+		r.switched = false
+		logger("[%s] Key rejected by the server. Using the %s key.", remote.Name, keyLabels[r.active])
+	}
+	// The secondary key is usually the one being retired, expiring on purpose
+	if at, ok := r.expires[r.keys[0]]; ok && r.keys[0] != "" && time.Since(r.warned) >= keyExpiryWarnEvery {
+		logger("[%s] API key expires %s. Replace it with 'sift remote rotate-key %s'.", remote.Name, at.Local().Format(time.RFC1123), remote.Name)
+		r.warned = time.Now()
+	}
+}
+
+// validateAuth checks the settings the remote's auth mode needs.
+func validateAuth(remote config.RemoteConfig) error {
+	switch strings.ToLower(remote.Auth) {
+	case "", config.AuthKey:
+		return nil
+	case config.AuthOAuth2:
+		if remote.TokenURL == "" || remote.ClientID == "" || remote.ClientSecret == "" {
+			return fmt.Errorf("oauth2 remote %s needs token_url, client_id and client_secret", remote.Name)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown auth mode %q", remote.Auth)
+}
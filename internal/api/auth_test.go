@@ -0,0 +1,167 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/go-resty/resty/v2"
+)
+
+// tokenServer is an OAuth2 token endpoint issuing tok-1, tok-2, ... to the
+// client "agent" with secret "s3cret".
+type tokenServer struct {
+	*httptest.Server
+	issued    atomic.Int32
+	expiresIn atomic.Int32
+}
+
+func newTokenServer(t *testing.T, expiresIn int) *tokenServer {
+	ts := &tokenServer{}
+	ts.expiresIn.Store(int32(expiresIn))
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		id, secret, _ := r.BasicAuth()
+		if r.FormValue("grant_type") != "client_credentials" || id != "agent" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_client","error_description":"unknown client"}`)
+			return
+		}
+		n := ts.issued.Add(1)
+		fmt.Fprintf(w, `{"access_token":"tok-%d","token_type":"Bearer","expires_in":%d}`, n, ts.expiresIn.Load())
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func oauthRemote(name string, ts *tokenServer) config.RemoteConfig {
+	return config.RemoteConfig{Name: name, Auth: "oauth2", TokenURL: ts.URL + "/token", ClientID: "agent", ClientSecret: "s3cret"}
+}
+
+func TestTokenIsCached(t *testing.T) {
+	ts := newTokenServer(t, 3600)
+	remote := oauthRemote("oauth-cache", ts)
+
+	for i := 0; i < 3; i++ {
+		token, err := bearerToken(context.Background(), remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "tok-1" {
+			t.Fatalf("request %d used %s", i, token)
+		}
+	}
+	if n := ts.issued.Load(); n != 1 {
+		t.Fatalf("%d token requests, want 1", n)
+	}
+}
+
+func TestTokenIsRefreshedBeforeExpiry(t *testing.T) {
+	ts := newTokenServer(t, 3600)
+	remote := oauthRemote("oauth-refresh", ts)
+	if _, err := bearerToken(context.Background(), remote); err != nil {
+		t.Fatal(err)
+	}
+
+	s := tokenSourceFor(remote)
+	s.mu.Lock()
+	until := time.Until(s.refreshAt)
+	s.mu.Unlock()
+	if until <= 58*time.Minute || until > 59*time.Minute {
+		t.Fatalf("refresh due in %s, want a minute before the hour is up", until)
+	}
+
+	// A short lifetime is renewed at 80%
+	ts.expiresIn.Store(1)
+	s.mu.Lock()
+	s.refreshAt = time.Now()
+	s.mu.Unlock()
+	if token, _ := bearerToken(context.Background(), remote); token != "tok-2" {
+		t.Fatalf("token due for refresh reused as %s", token)
+	}
+	time.Sleep(850 * time.Millisecond)
+	if token, _ := bearerToken(context.Background(), remote); token != "tok-3" {
+		t.Fatalf("token not refreshed ahead of expiry, got %s", token)
+	}
+}
+
+func TestTokenIsRefreshedOn401(t *testing.T) {
+	ts := newTokenServer(t, 3600)
+	var seen []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") == "Bearer tok-1" {
+			w.WriteHeader(http.StatusUnauthorized) // Revoked early
+		}
+	}))
+	defer api.Close()
+
+	remote := oauthRemote("oauth-401", ts)
+	remote.Endpoint = api.URL
+	client := withAuth(resty.New(), remote)
+
+	ok, lastErr := withRetries(context.Background(), remote, "doc.pdf", nil, func() error {
+		resp, err := client.R().Get(api.URL + "/agent/check")
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode() != 200 {
+			return statusError(resp, "check failed")
+		}
+		return nil
+	})
+	if !ok {
+		t.Fatalf("request failed after the token was renewed: %v", lastErr)
+	}
+	if len(seen) != 2 || seen[1] != "Bearer tok-2" {
+		t.Fatalf("requests sent with %v", seen)
+	}
+}
+
+func TestInvalidClientIsAuthError(t *testing.T) {
+	ts := newTokenServer(t, 3600)
+	remote := oauthRemote("oauth-invalid", ts)
+	remote.ClientSecret = "wrong"
+
+	_, err := bearerToken(context.Background(), remote)
+	var uerr *UploadError
+	if !errors.As(err, &uerr) || uerr.Class != ClassAuth || !errors.Is(err, errTokenRejected) {
+		t.Fatalf("rejected client reported as %v", err)
+	}
+	if Classify(err).Class != ClassAuth {
+		t.Fatal("rejected client not classified as auth")
+	}
+}
+
+// TestPinnedRemoteGetsToken pins the endpoint to a key the token server does
+// not have. The pins are the endpoint's, so the token request still succeeds.
+func TestPinnedRemoteGetsToken(t *testing.T) {
+	ts := &tokenServer{}
+	ts.expiresIn.Store(3600)
+	ts.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"tok-%d","expires_in":%d}`, ts.issued.Add(1), ts.expiresIn.Load())
+	}))
+	defer ts.Close()
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0o644)
+	remote := oauthRemote("oauth-pinned", ts)
+	remote.CAFiles = []string{ca}
+	remote.SPKIPins = []string{base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))}
+
+	if token, err := bearerToken(context.Background(), remote); err != nil || token != "tok-1" {
+		t.Fatalf("pinned remote got %q: %v", token, err)
+	}
+}
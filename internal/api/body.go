@@ -0,0 +1,264 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// Integrity metadata sent with every upload. HeaderContentSHA256 is only set
+// when the digest was computed before sending. The multipart body always ends
+// with a "sha256" form field holding the digest of the bytes actually streamed,
+// so single-pass uploads carry it too. The server echoes its own digest back as
+// HeaderContentSHA256 (or the "sha256" field of the JSON receipt) so the agent
+// can detect corruption in transit.
+const (
+	HeaderContentSHA256 = "X-Sift-Content-SHA256"
+	HeaderContentSize   = "X-Sift-Content-Size"
+	HeaderModTime       = "X-Sift-Mod-Time" // RFC 3339, UTC
+)
+
+const sniffLen = 512
+
+var hashPlaceholder = strings.Repeat("0", sha256.Size*2)
+
+// multipartBody is the framing of a single-file multipart/form-data body with
+// a trailing sha256 field. It is built up front so the file can be streamed
+// and the exact body length is known before sending.
+type multipartBody struct {
+	contentType string
+	fileType    string // Sniffed type of the file part
+	head        []byte
+	tail        []byte
+	hashAt      int // Offset of the sha256 value within tail
+}
+
+func newMultipartBody(fileName string, fileType string) (*multipartBody, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, escapeQuotes(fileName)))
+	h.Set("Content-Type", fileType)
+	if _, err := mw.CreatePart(h); err != nil {
+		return nil, err
+	}
+	head := append([]byte(nil), buf.Bytes()...)
+
+	buf.Reset()
+	if err := mw.WriteField("sha256", hashPlaceholder); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	tail := append([]byte(nil), buf.Bytes()...)
+
+	return &multipartBody{
+		contentType: mw.FormDataContentType(),
+		fileType:    fileType,
+		head:        head,
+		tail:        tail,
+		hashAt:      bytes.Index(tail, []byte(hashPlaceholder)),
+	}, nil
+}
+
+func (b *multipartBody) length(fileSize int64) int64 {
+	return int64(len(b.head)) + fileSize + int64(len(b.tail))
+}
+
+func (b *multipartBody) tailFor(sum string) []byte {
+	tail := append([]byte(nil), b.tail...)
+	copy(tail[b.hashAt:], sum)
+	return tail
+}
+
+// uploadStream is the request body of a single upload attempt. It hashes the
+// file bytes as they are sent and fills in the trailing sha256 field once the
+// file is exhausted, so each attempt reads the file exactly once and the
+// reported digest always matches what went over the wire.
+type uploadStream struct {
+	io.Reader
+	hasher hash.Hash
+	size   int64
+}
+
+func newUploadStream(body *multipartBody, file io.Reader) *uploadStream {
+	s := &uploadStream{hasher: sha256.New()}
+	s.Reader = io.MultiReader(
+		bytes.NewReader(body.head),
+		io.TeeReader(&countingReader{r: file, n: &s.size}, s.hasher),
+		&lazyReader{fill: func() []byte { return body.tailFor(s.Sum()) }},
+	)
+	return s
+}
+
+func (s *uploadStream) Sum() string {
+	return hex.EncodeToString(s.hasher.Sum(nil))
+}
+
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+// lazyReader defers building its content until the first Read.
+type lazyReader struct {
+	fill func() []byte
+	r    *bytes.Reader
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	if l.r == nil {
+		l.r = bytes.NewReader(l.fill())
+	}
+	return l.r.Read(p)
+}
+
+// openUpload opens the file and builds the multipart framing from its first
+// bytes. The returned reader yields the whole file, sniffed bytes included.
+// With env set it yields the ciphertext, and the type is not sniffed.
+func openUpload(filePath string, fileName string, env *envelope) (*os.File, io.Reader, *multipartBody, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if env != nil {
+		body, err := newMultipartBody(fileName, "application/octet-stream")
+		if err != nil {
+			f.Close()
+			return nil, nil, nil, err
+		}
+		return f, env.seal(f), body, nil
+	}
+
+	sniff := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, sniff)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	sniff = sniff[:n]
+
+	body, err := newMultipartBody(fileName, http.DetectContentType(sniff))
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	return f, io.MultiReader(bytes.NewReader(sniff), f), body, nil
+}
+
+type uploadDigest struct {
+	sha256 string // Hex SHA-256 of the file as sent, the ciphertext when encrypted
+	md5    string // Base64 MD5 of the whole request body, empty if not requested
+	body   string // Hex SHA-256 of the whole request body, for signing, empty if not requested
+	size   int64
+}
+
+// digestFile hashes the file ahead of sending, for the cases that need the
+// digest before the transfer starts. When withMD5 or withBody is set it also
+// hashes the complete multipart body, for the Content-MD5 header or the
+// request signature, which fixes the body framing used for the upload.
+func digestFile(filePath string, fileName string, env *envelope, withMD5 bool, withBody bool) (uploadDigest, *multipartBody, error) {
+	f, src, body, err := openUpload(filePath, fileName, env)
+	if err != nil {
+		return uploadDigest{}, nil, err
+	}
+	defer f.Close()
+
+	fileHash := sha256.New()
+	var md5Hash, bodyHash hash.Hash
+	writers := []io.Writer{fileHash}
+	if withMD5 {
+		md5Hash = md5.New()
+		writers = append(writers, md5Hash)
+	}
+	if withBody {
+		bodyHash = sha256.New()
+		writers = append(writers, bodyHash)
+	}
+	bodyWriter := io.MultiWriter(writers[1:]...)
+	bodyWriter.Write(body.head)
+
+	size, err := io.Copy(io.MultiWriter(writers...), src)
+	if err != nil {
+		return uploadDigest{}, nil, err
+	}
+
+	d := uploadDigest{sha256: hex.EncodeToString(fileHash.Sum(nil)), size: size}
+	if len(writers) == 1 {
+		return d, nil, nil
+	}
+	bodyWriter.Write(body.tailFor(d.sha256))
+	if md5Hash != nil {
+		d.md5 = base64.StdEncoding.EncodeToString(md5Hash.Sum(nil))
+	}
+	if bodyHash != nil {
+		d.body = hex.EncodeToString(bodyHash.Sum(nil))
+	}
+	return d, body, nil
+}
+
+type streamBodyKey struct{}
+
+// withStreamBody attaches body to a request context for streamBody. resty
+// reads any io.Reader body fully into memory to make it replayable, so
+// streamed uploads are handed to the transport this way instead of through
+// SetBody.
+func withStreamBody(ctx context.Context, body io.Reader) context.Context {
+	return context.WithValue(ctx, streamBodyKey{}, body)
+}
+
+// streamBody sends the body attached by withStreamBody, with the length from
+// an explicit Content-Length header. Without one the body goes out chunked.
+// Requests without a body are sent with an explicit zero length.
+func streamBody(_ *resty.Client, req *http.Request) error {
+	body, ok := req.Context().Value(streamBodyKey{}).(io.Reader)
+	if !ok {
+		// resty replaces an absent body with an empty buffer of unknown
+		// length, which would go out chunked
+		if req.ContentLength == 0 && req.GetBody != nil {
+			if rc, err := req.GetBody(); err == nil {
+				if n, _ := rc.Read(make([]byte, 1)); n == 0 {
+					req.Body, req.GetBody = http.NoBody, nil
+				}
+			}
+		}
+		return nil
+	}
+	req.Body = io.NopCloser(body)
+	req.GetBody = nil
+	req.ContentLength = -1
+	if v := req.Header.Get("Content-Length"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			req.ContentLength = n
+		}
+	}
+	return nil
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func escapeQuotes(s string) string {
+	return quoteEscaper.Replace(s)
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/go-resty/resty/v2"
+)
+
+// TestStreamBodyIsNotBuffered sends a body that is only written once the
+// server has received the request headers. A client that reads the body
+// into memory first never gets there.
+func TestStreamBodyIsNotBuffered(t *testing.T) {
+	started := make(chan struct{})
+	received := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		if r.ContentLength != 5 {
+			t.Errorf("Content-Length = %d, want 5", r.ContentLength)
+		}
+		data, _ := io.ReadAll(r.Body)
+		received <- string(data)
+	}))
+	defer srv.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		select {
+		case <-started:
+			pw.Write([]byte("hello"))
+			pw.Close()
+		case <-time.After(5 * time.Second):
+			pw.CloseWithError(io.ErrUnexpectedEOF)
+		}
+	}()
+
+	client := resty.New().SetPreRequestHook(streamBody)
+	_, err := client.R().
+		SetContext(withStreamBody(context.Background(), pr)).
+		SetHeader("Content-Length", "5").
+		Post(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; got != "hello" {
+		t.Fatalf("server received %q", got)
+	}
+}
+
+func TestSendFileStreams(t *testing.T) {
+	content := strings.Repeat("sift agent test data\n", 10000)
+	sum := sha256.Sum256([]byte(content))
+	want := hex.EncodeToString(sum[:])
+
+	path := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compression := range []string{config.CompressionOff, config.CompressionGzip} {
+		t.Run(compression, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body io.Reader = r.Body
+				if compression == config.CompressionGzip {
+					if r.Header.Get("Content-Encoding") != "gzip" || r.ContentLength != -1 {
+						t.Errorf("want a chunked gzip body, got encoding %q length %d", r.Header.Get("Content-Encoding"), r.ContentLength)
+					}
+					gz, err := gzip.NewReader(r.Body)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					body = gz
+					r.Header.Del("Content-Encoding")
+				} else if r.ContentLength <= int64(len(content)) {
+					t.Errorf("Content-Length = %d, want the full multipart length", r.ContentLength)
+				}
+				r.Body = io.NopCloser(body)
+				if err := r.ParseMultipartForm(1 << 20); err != nil {
+					t.Error(err)
+					return
+				}
+				f, _, err := r.FormFile("file")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				got, _ := io.ReadAll(f)
+				if string(got) != content {
+					t.Errorf("file part differs from the file, %d bytes", len(got))
+				}
+				if r.FormValue("sha256") != want {
+					t.Errorf("sha256 field = %q, want %q", r.FormValue("sha256"), want)
+				}
+				w.WriteHeader(http.StatusCreated)
+			}))
+			defer srv.Close()
+
+			remote := config.RemoteConfig{Name: "stream-" + compression, Endpoint: srv.URL, Compression: compression}
+			recordCapabilities(srv.URL, []byte(`{"capabilities":["gzip"]}`))
+			client := resty.New().SetPreRequestHook(streamBody)
+
+			sent, _, err := sendFile(context.Background(), client, remote, path, time.Now().UnixNano(), uploadDigest{}, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sent != want {
+				t.Fatalf("sendFile returned %s, want %s", sent, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/go-resty/resty/v2"
+)
+
+// Circuit breaker states. A breaker opens after breakerThreshold consecutive
+// failures to reach the endpoint (transport errors and 5xx). While open,
+// uploads are held. A successful heartbeat, or recovery check on destinations
+// without heartbeats, moves it to half-open, which admits a single trial
+// request; its outcome closes or reopens the breaker.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+const (
+	breakerThreshold     = 5
+	breakerTrialTTL      = 2 * time.Minute  // A trial that never reports back is handed to another caller
+	breakerProbeInterval = 15 * time.Second // Recovery checks for destinations without heartbeats
+)
+
+type breaker struct {
+	mu         sync.Mutex
+	state      string
+	failures   int
+	trialUntil time.Time
+	changed    chan struct{} // Closed and replaced on every state change
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = make(map[string]*breaker)
+)
+
+func breakerFor(endpoint string) *breaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[endpoint]
+	if !ok {
+		b = &breaker{state: BreakerClosed, changed: make(chan struct{})}
+		breakers[endpoint] = b
+	}
+	return b
+}
+
+// setState must be called with b.mu held.
+func (b *breaker) setState(state string) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+	b.trialUntil = time.Time{}
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.setState(BreakerClosed)
+}
+
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= breakerThreshold {
+		b.setState(BreakerOpen)
+	}
+}
+
+// recovered records a successful heartbeat. It resets the failure count of a
+// closed breaker, so only consecutive failures open it, and half-opens an open
+// one, reporting whether it did. A half-open breaker waits for its trial.
+func (b *breaker) recovered() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerClosed:
+		b.failures = 0
+	case BreakerOpen:
+		b.setState(BreakerHalfOpen)
+		return true
+	}
+	return false
+}
+
+// BreakerState returns the state of the endpoint's circuit breaker.
+func BreakerState(endpoint string) string {
+	b := breakerFor(endpoint)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// AwaitEndpoint blocks while the endpoint's breaker is open, or half-open with
+// its trial already taken. It returns false if ctx ends first.
+func AwaitEndpoint(ctx context.Context, endpoint string) bool {
+	b := breakerFor(endpoint)
+	for {
+		b.mu.Lock()
+		switch {
+		case b.state == BreakerClosed:
+			b.mu.Unlock()
+			return true
+		case b.state == BreakerHalfOpen && time.Now().After(b.trialUntil):
+			b.trialUntil = time.Now().Add(breakerTrialTTL)
+			b.mu.Unlock()
+			return true
+		}
+		changed := b.changed
+		wait := time.Until(b.trialUntil)
+		b.mu.Unlock()
+
+		if wait <= 0 {
+			wait = breakerTrialTTL
+		}
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// WatchRecovery stands in for the heartbeat on destinations that have none.
+// While the remote's breaker is open it checks the destination periodically,
+// and half-opens the breaker once the destination answers.
+func WatchRecovery(ctx context.Context, remote config.RemoteConfig, uploader Uploader) {
+	b := breakerFor(remote.Endpoint)
+	for {
+		b.mu.Lock()
+		state, changed := b.state, b.changed
+		b.mu.Unlock()
+
+		if state != BreakerOpen {
+			select {
+			case <-changed:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-time.After(breakerProbeInterval):
+		case <-ctx.Done():
+			return
+		}
+		// A refusal still proves the destination is reachable
+		if err := uploader.Check(ctx, remote); err == nil || Classify(err).Class != ClassTransient {
+			b.recovered()
+		}
+	}
+}
+
+// trackEndpoint feeds every response and transport error seen by client into
+// the endpoint's breaker. Any answer below 500 proves the server is reachable.
+func trackEndpoint(client *resty.Client, endpoint string) *resty.Client {
+	b := breakerFor(endpoint)
+	return client.
+		OnAfterResponse(func(_ *resty.Client, resp *resty.Response) error {
+			if resp.StatusCode() >= 500 {
+				b.failure()
+			} else {
+				b.success()
+			}
+			return nil
+		}).
+		OnError(func(req *resty.Request, err error) {
+			var respErr *resty.ResponseError
+			if errors.As(err, &respErr) || req.Context().Err() != nil {
+				return
+			}
+			// Rejected client credentials say nothing about the endpoint
+			var uerr *UploadError
+			if errors.As(err, &uerr) && uerr.Class == ClassAuth {
+				return
+			}
+			b.failure()
+		})
+}
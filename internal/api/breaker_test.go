@@ -0,0 +1,26 @@
+package api
+
+import "testing"
+
+func TestAcceptedHeartbeatsResetFailures(t *testing.T) {
+	b := breakerFor("http://breaker-heartbeat.test")
+	for i := 0; i < breakerThreshold*3; i++ {
+		b.failure()
+		if i%2 == 1 {
+			b.recovered()
+		}
+	}
+	if state := BreakerState("http://breaker-heartbeat.test"); state != BreakerClosed {
+		t.Fatalf("sporadic failures left the breaker %s", state)
+	}
+
+	for i := 0; i < breakerThreshold; i++ {
+		b.failure()
+	}
+	if !b.recovered() || BreakerState("http://breaker-heartbeat.test") != BreakerHalfOpen {
+		t.Fatal("a heartbeat after consecutive failures should half-open the breaker")
+	}
+	if b.recovered() || BreakerState("http://breaker-heartbeat.test") != BreakerHalfOpen {
+		t.Fatal("a half-open breaker should wait for its trial")
+	}
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Capabilities a server may advertise in its /agent/check response:
+//
+//	{"capabilities": ["hash_lookup"]}
+//
+// Servers that return an empty or non-JSON body advertise nothing, and the
+// agent falls back to the original upload protocol.
+//
+// The response may also carry setting overrides for the reporting remote,
+// keyed by their config names:
+//
+//	{"capabilities": [...], "config": {"settling_delay": "10s", "concurrency_limit": 8}}
+//
+// When "config" is present it is the complete set: fields it no longer lists
+// revert to the local configuration.
+const (
+	CapHashLookup = "hash_lookup" // GET /agent/exists?sha256=<hex>
+	CapVerify     = "verify"      // GET /agent/documents/<document_id>
+	CapResumable  = "resumable"   // Chunked uploads under /agent/uploads
+	CapGzip       = "gzip"        // Accepts Content-Encoding: gzip request bodies
+	CapZstd       = "zstd"        // Accepts Content-Encoding: zstd request bodies
+)
+
+type checkResponse struct {
+	Capabilities []string               `json:"capabilities"`
+	Config       map[string]interface{} `json:"config"`
+}
+
+var (
+	capsMu     sync.RWMutex
+	capsByHost = make(map[string]map[string]bool)
+)
+
+// recordCapabilities stores the capability set parsed from a successful
+// /agent/check response for the given endpoint.
+func recordCapabilities(endpoint string, body []byte) {
+	var parsed checkResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		parsed.Capabilities = nil
+	}
+
+	caps := make(map[string]bool, len(parsed.Capabilities))
+	for _, c := range parsed.Capabilities {
+		caps[c] = true
+	}
+
+	capsMu.Lock()
+	capsByHost[endpoint] = caps
+	capsMu.Unlock()
+}
+
+// HasCapability reports whether the endpoint advertised the capability in its
+// most recent heartbeat.
+func HasCapability(endpoint string, capability string) bool {
+	capsMu.RLock()
+	defer capsMu.RUnlock()
+	return capsByHost[endpoint][capability]
+}
+
+// parseOverrides extracts the setting overrides from a /agent/check response,
+// with values rendered as they would be written in the config file. ok is
+// false when the response carries no "config" object.
+func parseOverrides(body []byte) (map[string]string, bool) {
+	var parsed checkResponse
+	if err := json.Unmarshal(body, &parsed); err != nil || parsed.Config == nil {
+		return nil, false
+	}
+
+	overrides := make(map[string]string, len(parsed.Config))
+	for field, v := range parsed.Config {
+		switch v := v.(type) {
+		case string:
+			overrides[field] = v
+		case float64:
+			overrides[field] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			overrides[field] = fmt.Sprint(v)
+		}
+	}
+	return overrides, true
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/cleverdata/sift-agent/internal/metrics"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Formats that are already compressed and gain nothing from another pass.
+var precompressedExts = map[string]bool{
+	".pdf": true, ".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true,
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true, ".7z": true, ".rar": true,
+	".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".ods": true,
+	".mp3": true, ".mp4": true, ".mov": true,
+}
+
+var precompressedTypes = []string{
+	"application/pdf", "application/zip", "application/x-gzip", "application/x-rar-compressed",
+	"image/jpeg", "image/png", "image/gif", "image/webp", "audio/", "video/",
+}
+
+// chooseEncoding returns the Content-Encoding for a file, or "" to send it raw.
+// An encoding is only used when the server advertised it. Content-MD5 has to
+// cover the encoded body, which is not known up front, so the two are exclusive.
+// Ciphertext does not compress, encrypted files are sent raw.
+func chooseEncoding(remote config.RemoteConfig, fileName string, fileType string) string {
+	if remote.ContentMD5 || Encrypts(remote) {
+		return ""
+	}
+
+	switch strings.ToLower(remote.Compression) {
+	case config.CompressionGzip:
+		if HasCapability(remote.Endpoint, CapGzip) {
+			return "gzip"
+		}
+	case config.CompressionZstd:
+		if HasCapability(remote.Endpoint, CapZstd) {
+			return "zstd"
+		}
+	case config.CompressionAuto:
+		if isPrecompressed(fileName, fileType) {
+			return ""
+		}
+		if HasCapability(remote.Endpoint, CapZstd) {
+			return "zstd"
+		}
+		if HasCapability(remote.Endpoint, CapGzip) {
+			return "gzip"
+		}
+	}
+	return ""
+}
+
+func isPrecompressed(fileName string, fileType string) bool {
+	if precompressedExts[strings.ToLower(filepath.Ext(fileName))] {
+		return true
+	}
+	for _, t := range precompressedTypes {
+		if strings.HasPrefix(fileType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func newEncoder(w io.Writer, encoding string) (io.WriteCloser, error) {
+	if encoding == "zstd" {
+		return zstd.NewWriter(w)
+	}
+	return gzip.NewWriter(w), nil
+}
+
+// compressStream encodes src on the fly. The returned reader must be closed
+// so the encoding goroutine exits if the request is abandoned. wire counts the
+// encoded bytes as they are read.
+func compressStream(src io.Reader, encoding string, wire *int64) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	enc, err := newEncoder(pw, encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		_, err := io.Copy(enc, src)
+		if cerr := enc.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{&countingReader{r: pr, n: wire}, pr}, nil
+}
+
+// compressChunk encodes a whole in-memory chunk for resumable uploads.
+func compressChunk(chunk []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	enc, err := newEncoder(&buf, encoding)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := enc.Write(chunk); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func recordCompression(remote config.RemoteConfig, encoding string, raw int64, wire int64) {
+	metrics.CompressionInputBytes.Add(float64(raw), remote.Name, encoding)
+	metrics.CompressionOutputBytes.Add(float64(wire), remote.Name, encoding)
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestChooseEncoding(t *testing.T) {
+	both := "http://compress-both"
+	recordCapabilities(both, []byte(`{"capabilities":["gzip","zstd"]}`))
+	gzipOnly := "http://compress-gzip"
+	recordCapabilities(gzipOnly, []byte(`{"capabilities":["gzip"]}`))
+
+	for _, tc := range []struct {
+		remote   config.RemoteConfig
+		name     string
+		fileType string
+		want     string
+	}{
+		{config.RemoteConfig{Endpoint: both, Compression: "auto"}, "ledger.csv", "text/plain; charset=utf-8", "zstd"},
+		{config.RemoteConfig{Endpoint: gzipOnly, Compression: "auto"}, "ledger.csv", "text/plain; charset=utf-8", "gzip"},
+		{config.RemoteConfig{Endpoint: both, Compression: "auto"}, "scan.pdf", "application/pdf", ""},
+		{config.RemoteConfig{Endpoint: both, Compression: "auto"}, "scan", "image/png", ""},
+		{config.RemoteConfig{Endpoint: both, Compression: "auto"}, "archive.ZIP", "application/octet-stream", ""},
+		{config.RemoteConfig{Endpoint: both, Compression: "gzip"}, "scan.pdf", "application/pdf", "gzip"},
+		{config.RemoteConfig{Endpoint: gzipOnly, Compression: "zstd"}, "ledger.csv", "text/plain", ""},
+		{config.RemoteConfig{Endpoint: "http://compress-none", Compression: "auto"}, "ledger.csv", "text/plain", ""},
+		{config.RemoteConfig{Endpoint: both}, "ledger.csv", "text/plain", ""},
+		{config.RemoteConfig{Endpoint: both, Compression: "zstd", ContentMD5: true}, "ledger.csv", "text/plain", ""},
+		{config.RemoteConfig{Endpoint: both, Compression: "zstd", EncryptTo: "recipient.pem"}, "ledger.csv", "text/plain", ""},
+	} {
+		if got := chooseEncoding(tc.remote, tc.name, tc.fileType); got != tc.want {
+			t.Errorf("%+v, %s (%s): encoding %q, want %q", tc.remote, tc.name, tc.fileType, got, tc.want)
+		}
+	}
+}
+
+// TestCompressedBodyMatchesDigest uploads with each encoding and checks that
+// the decoded body hashes to the signed body digest and carries the file.
+func TestCompressedBodyMatchesDigest(t *testing.T) {
+	content := []byte(strings.Repeat("date,amount,account\n2026-01-02,120.50,4711\n", 4000))
+	path := filepath.Join(t.TempDir(), "ledger.csv")
+	os.WriteFile(path, content, 0o644)
+
+	for _, encoding := range []string{"gzip", "zstd"} {
+		var got, wire int
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			raw, _ := io.ReadAll(r.Body)
+			wire = len(raw)
+			var decoded []byte
+			switch r.Header.Get("Content-Encoding") {
+			case "gzip":
+				zr, err := gzip.NewReader(bytes.NewReader(raw))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				decoded, _ = io.ReadAll(zr)
+			case "zstd":
+				zr, _ := zstd.NewReader(bytes.NewReader(raw))
+				decoded, _ = io.ReadAll(zr)
+				zr.Close()
+			default:
+				t.Errorf("sent with Content-Encoding %q, want %s", r.Header.Get("Content-Encoding"), encoding)
+				return
+			}
+
+			sum := sha256.Sum256(decoded)
+			if r.Header.Get(HeaderBodySHA256) != hex.EncodeToString(sum[:]) {
+				t.Errorf("%s: decoded body does not match %s", encoding, HeaderBodySHA256)
+			}
+			_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			part, err := multipart.NewReader(bytes.NewReader(decoded), params["boundary"]).NextPart()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			file, _ := io.ReadAll(part)
+			if bytes.Equal(file, content) {
+				got++
+			}
+			w.WriteHeader(http.StatusCreated)
+		}))
+		recordCapabilities(srv.URL, []byte(`{"capabilities":["gzip","zstd"]}`))
+
+		remote := config.RemoteConfig{Name: "compress-" + encoding, Endpoint: srv.URL, Key: "k",
+			SigningKey: "s1gn", Compression: encoding, RetryAttempts: 1}
+		var failure error
+		UploadFile(t.Context(), remote, path, time.Now().UnixNano(), nil,
+			func(_ string, err error) { failure = err }, nil)
+		srv.Close()
+		if failure != nil {
+			t.Fatal(failure)
+		}
+		if got != 1 || wire >= len(content) {
+			t.Fatalf("%s: file received %d times, %d bytes on the wire for %d", encoding, got, wire, len(content))
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+)
+
+// Directory destination: a local or UNC directory, never created by the agent.
+// Copies are synced, verified and renamed into place, see docs/destinations.md.
+
+type dirUploader struct{}
+
+func (dirUploader) Upload(ctx context.Context, remote config.RemoteConfig, filePath string, modTime int64,
+	onSuccess func(string, string, int64, Receipt), onError func(string, error), logger func(string, ...interface{})) {
+
+	fileName := filepath.Base(filePath)
+	info, err := os.Stat(filePath)
+	if err != nil {
+		failLocal(filePath, err, onError)
+		return
+	}
+
+	target := filepath.Join(remote.Endpoint, filepath.FromSlash(destinationKey(remote, filePath, time.Now())))
+	var hash string
+	ok, lastErr := withRetries(ctx, remote, fileName, logger, func() error {
+		var err error
+		hash, err = dirCopy(ctx, remote, filePath, target, info.Size(), modTime)
+		return err
+	})
+
+	if ok {
+		if onSuccess != nil {
+			onSuccess(filePath, hash, modTime, Receipt{DocumentID: target, SHA256: hash, Size: info.Size()})
+		}
+		return
+	}
+	if onError != nil && lastErr != nil {
+		onError(filePath, lastErr)
+	}
+}
+
+// Check confirms the directory is mounted and writable.
+func (dirUploader) Check(ctx context.Context, remote config.RemoteConfig) error {
+	if err := dirAvailable(remote); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(remote.Endpoint, ".sift-check-*")
+	if err != nil {
+		return dirError(err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+// dirCopy copies the file to a temporary name next to target, syncs and
+// verifies it, and renames it into place. It returns the SHA-256 of the copy.
+func dirCopy(ctx context.Context, remote config.RemoteConfig, filePath string, target string, size int64, modTime int64) (string, error) {
+	b := breakerFor(remote.Endpoint)
+	if err := dirAvailable(remote); err != nil {
+		b.failure()
+		return "", err
+	}
+
+	src, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dir := filepath.Dir(target)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", dirError(err)
+	}
+	tmp := filepath.Join(dir, "."+filepath.Base(target)+".part")
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", dirError(err)
+	}
+
+	hasher := sha256.New()
+	n, err := io.Copy(dst, &ctxReader{ctx: ctx, r: io.TeeReader(src, hasher)})
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", dirError(err)
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if n != size {
+		os.Remove(tmp)
+		return "", &UploadError{Class: ClassTransient, Err: fmt.Errorf("file changed while copying: expected %d bytes, copied %d", size, n)}
+	}
+
+	// Read the copy back, so a share that corrupts or truncates writes is caught
+	copied, err := HashFile(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return "", dirError(err)
+	}
+	if copied != hash {
+		os.Remove(tmp)
+		return "", &UploadError{Class: ClassTransient, Err: fmt.Errorf("copy verification failed: sent sha256 %s, destination has %s", hash, copied)}
+	}
+	os.Chtimes(tmp, time.Now(), time.Unix(0, modTime))
+
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return "", dirError(err)
+	}
+	syncDir(dir)
+	b.success()
+	return hash, nil
+}
+
+// dirAvailable reports the endpoint directory missing as a transient failure.
+func dirAvailable(remote config.RemoteConfig) error {
+	info, err := os.Stat(remote.Endpoint)
+	if err != nil {
+		return &UploadError{Class: ClassTransient, Err: fmt.Errorf("destination directory unavailable: %w", err)}
+	}
+	if !info.IsDir() {
+		return &UploadError{Class: ClassPermanent, Err: fmt.Errorf("destination %s is not a directory", remote.Endpoint)}
+	}
+	return nil
+}
+
+// dirError classifies a filesystem failure. Missing write permission is a
+// problem of the remote, not of the file.
+func dirError(err error) error {
+	if errors.Is(err, os.ErrPermission) {
+		return &UploadError{Class: ClassAuth, Err: fmt.Errorf("permission denied: %w", err)}
+	}
+	return Classify(err)
+}
+
+// syncDir flushes the directory entry of a rename. Windows cannot open
+// directories for syncing and commits renames on its own.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// ctxReader stops a copy between reads once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// validateDir checks that a directory remote names an absolute path outside
+// the folder it watches, which would otherwise pick up its own copies.
+func validateDir(remote config.RemoteConfig) error {
+	if remote.Endpoint == "" || !filepath.IsAbs(remote.Endpoint) {
+		return fmt.Errorf("dir remote %s needs an absolute directory as endpoint, got %q", remote.Name, remote.Endpoint)
+	}
+	if remote.Path == "" {
+		return nil
+	}
+	watched, err := filepath.Abs(remote.Path)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(watched, remote.Endpoint)
+	if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("dir remote %s writes into the folder it watches: %s is inside %s", remote.Name, remote.Endpoint, watched)
+	}
+	return nil
+}
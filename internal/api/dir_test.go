@@ -0,0 +1,109 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+)
+
+func TestValidateDirRejectsWatchedFolder(t *testing.T) {
+	watched := t.TempDir()
+	for endpoint, ok := range map[string]bool{
+		watched:                                  false,
+		filepath.Join(watched, "out"):            false,
+		filepath.Join(watched, "..", "out"):      true,
+		filepath.Join(watched+"-out", "archive"): true,
+	} {
+		err := validateDir(config.RemoteConfig{Name: "copy", Path: watched, Endpoint: endpoint})
+		if (err == nil) != ok {
+			t.Errorf("endpoint %s: %v", endpoint, err)
+		}
+	}
+}
+
+func dirFixture(t *testing.T) (config.RemoteConfig, string, []byte) {
+	t.Helper()
+	content := []byte("scanned contract")
+	src := filepath.Join(t.TempDir(), "contract.pdf")
+	if err := os.WriteFile(src, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	endpoint := t.TempDir()
+	return config.RemoteConfig{Name: "dir-" + endpoint, Type: config.TypeDir, Endpoint: endpoint}, src, content
+}
+
+func TestDirCopy(t *testing.T) {
+	remote, src, content := dirFixture(t)
+	target := filepath.Join(remote.Endpoint, "2026", "contract.pdf")
+	modTime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	hash, err := dirCopy(context.Background(), remote, src, target, int64(len(content)), modTime.UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	if hash != hex.EncodeToString(sum[:]) {
+		t.Fatalf("reported sha256 %s", hash)
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(target); string(got) != string(content) || !info.ModTime().Equal(modTime) {
+		t.Fatalf("copy is %q modified %s", got, info.ModTime())
+	}
+	if parts, _ := filepath.Glob(filepath.Join(remote.Endpoint, "2026", ".*.part")); len(parts) != 0 {
+		t.Fatalf("temporary files left: %v", parts)
+	}
+}
+
+func TestDirCopyFailures(t *testing.T) {
+	remote, src, content := dirFixture(t)
+	target := filepath.Join(remote.Endpoint, "contract.pdf")
+
+	// The file grew after it was measured
+	_, err := dirCopy(context.Background(), remote, src, target, int64(len(content))-1, 0)
+	if uerr, ok := err.(*UploadError); !ok || uerr.Class != ClassTransient {
+		t.Fatalf("size change reported as %v", err)
+	}
+	if _, err := os.Stat(target); err == nil {
+		t.Fatal("changed file was renamed into place")
+	}
+
+	// The share is not mounted
+	missing := remote
+	missing.Name, missing.Endpoint = "dir-missing", filepath.Join(remote.Endpoint, "unmounted")
+	_, err = dirCopy(context.Background(), missing, src, filepath.Join(missing.Endpoint, "contract.pdf"), int64(len(content)), 0)
+	if uerr, ok := err.(*UploadError); !ok || uerr.Class != ClassTransient {
+		t.Fatalf("missing endpoint reported as %v", err)
+	}
+	if _, err := os.Stat(missing.Endpoint); err == nil {
+		t.Fatal("missing endpoint was created")
+	}
+}
+
+func TestDirPermissionIsAuthError(t *testing.T) {
+	if err := dirError(fmt.Errorf("open: %w", fs.ErrPermission)); Classify(err).Class != ClassAuth {
+		t.Fatalf("permission error classified as %v", Classify(err).Class)
+	}
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("needs a user the directory mode applies to")
+	}
+
+	remote, src, content := dirFixture(t)
+	os.Chmod(remote.Endpoint, 0o555)
+	defer os.Chmod(remote.Endpoint, 0o755)
+	_, err := dirCopy(context.Background(), remote, src, filepath.Join(remote.Endpoint, "contract.pdf"), int64(len(content)), 0)
+	if uerr, ok := err.(*UploadError); !ok || uerr.Class != ClassAuth {
+		t.Fatalf("read-only endpoint reported as %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+)
+
+// Client-side envelope encryption for remotes with encrypt_to. The format is
+// described in docs/encryption.md.
+const (
+	HeaderEncryption      = "X-Sift-Encryption"
+	HeaderEncryptionKey   = "X-Sift-Encryption-Key"
+	HeaderEncryptionKeyID = "X-Sift-Encryption-Key-Id"
+
+	segmentSize      = 64 * 1024
+	encryptionScheme = "aes-256-gcm-stream; segment=65536"
+)
+
+// Encrypts reports whether the remote encrypts files before upload.
+func Encrypts(remote config.RemoteConfig) bool {
+	return remote.EncryptTo != ""
+}
+
+// SealedSize returns the size of the ciphertext of a file of size n.
+func SealedSize(n int64) int64 {
+	segments := (n + segmentSize - 1) / segmentSize
+	if segments == 0 {
+		segments = 1
+	}
+	return n + segments*16
+}
+
+// envelope holds the data key of one upload attempt. Nonces depend only on
+// the segment index, so a data key must never seal two different plaintexts.
+type envelope struct {
+	aead    cipher.AEAD
+	headers map[string]string
+}
+
+func newEnvelope(remote config.RemoteConfig) (*envelope, error) {
+	recipient, keyID, err := loadRecipient(remote.EncryptTo)
+	if err != nil {
+		return nil, err
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, recipient, dataKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("wrapping data key: %w", err)
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &envelope{
+		aead: aead,
+		headers: map[string]string{
+			HeaderEncryption:      encryptionScheme,
+			HeaderEncryptionKey:   base64.StdEncoding.EncodeToString(wrapped),
+			HeaderEncryptionKeyID: keyID,
+		},
+	}, nil
+}
+
+// seal returns a reader of the ciphertext of r.
+func (e *envelope) seal(r io.Reader) *sealingReader {
+	s := &sealingReader{aead: e.aead, plain: sha256.New(), buf: make([]byte, segmentSize+1)}
+	s.src = io.TeeReader(r, s.plain)
+	return s
+}
+
+// sealingReader encrypts its source segment by segment. It reads one byte
+// ahead to tell the final segment.
+type sealingReader struct {
+	src   io.Reader
+	aead  cipher.AEAD
+	plain hash.Hash
+	buf   []byte // Next segment and one byte of lookahead
+	have  int
+	out   []byte
+	seg   uint64
+	done  bool
+}
+
+func (s *sealingReader) Read(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.sealNext(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
+
+func (s *sealingReader) sealNext() error {
+	n, err := io.ReadFull(s.src, s.buf[s.have:])
+	s.have += n
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	}
+
+	size := min(s.have, segmentSize)
+	nonce := make([]byte, s.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, s.seg)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	s.out = s.aead.Seal(s.out[:0], nonce, s.buf[:size], nil)
+	s.have = copy(s.buf, s.buf[size:s.have])
+	s.seg++
+	s.done = last
+	return nil
+}
+
+// PlainSum returns the SHA-256 of the plaintext read so far.
+func (s *sealingReader) PlainSum() string {
+	return hex.EncodeToString(s.plain.Sum(nil))
+}
+
+// loadRecipient reads an RSA public key, or a certificate holding one, from a
+// PEM file and returns it with its key ID.
+func loadRecipient(path string) (*rsa.PublicKey, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("encrypt_to: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, "", fmt.Errorf("encrypt_to %s holds no PEM data", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		err = fmt.Errorf("unexpected PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("encrypt_to %s: %w", path, err)
+	}
+
+	recipient, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, "", fmt.Errorf("encrypt_to %s is not an RSA public key", path)
+	}
+	if recipient.N.BitLen() < 2048 {
+		return nil, "", fmt.Errorf("encrypt_to %s: RSA key of %d bits is too short, at least 2048 are needed", path, recipient.N.BitLen())
+	}
+	der, err := x509.MarshalPKIXPublicKey(recipient)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(der)
+	return recipient, hex.EncodeToString(sum[:]), nil
+}
+
+// validateEncryption checks the recipient key of a remote that encrypts.
+func validateEncryption(remote config.RemoteConfig) error {
+	if !Encrypts(remote) {
+		return nil
+	}
+	if strings.EqualFold(remote.DedupPolicy, config.DedupReference) {
+		return errors.New("dedup_policy reference cannot be used with encrypt_to, the server cannot match ciphertext")
+	}
+	_, _, err := loadRecipient(remote.EncryptTo)
+	return err
+}
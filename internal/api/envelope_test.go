@@ -0,0 +1,122 @@
+package api
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+)
+
+func openSealed(t *testing.T, priv *rsa.PrivateKey, wrapped string, ct []byte) []byte {
+	t.Helper()
+	w, _ := base64.StdEncoding.DecodeString(wrapped)
+	key, err := rsa.DecryptOAEP(sha256.New(), nil, priv, w, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	var plain []byte
+	for i := uint64(0); ; i++ {
+		n := min(len(ct), segmentSize+aead.Overhead())
+		last := n == len(ct)
+		nonce := make([]byte, aead.NonceSize())
+		binary.BigEndian.PutUint64(nonce, i)
+		if last {
+			nonce[len(nonce)-1] = 1
+		}
+		pt, err := aead.Open(nil, nonce, ct[:n], nil)
+		if err != nil {
+			t.Fatalf("segment %d: %v", i, err)
+		}
+		plain = append(plain, pt...)
+		if ct = ct[n:]; last {
+			return plain
+		}
+	}
+}
+
+// TestRetriesSealUnderNewKeys fails the first attempt and checks the retry
+// went out under another data key, with a Content-MD5 of its own body.
+func TestRetriesSealUnderNewKeys(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "recipient.pem")
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644)
+
+	content := []byte(strings.Repeat("confidential ", 12000)) // Several segments
+	path := filepath.Join(dir, "contract.txt")
+	os.WriteFile(path, content, 0o644)
+
+	var mu sync.Mutex
+	var keys []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sum := md5.Sum(body)
+		if r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(sum[:]) {
+			t.Error("Content-MD5 does not match the body of its attempt")
+		}
+		r.Body = io.NopCloser(strings.NewReader(string(body)))
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ct, _ := io.ReadAll(f)
+		if got := openSealed(t, priv, r.Header.Get(HeaderEncryptionKey), ct); string(got) != string(content) {
+			t.Error("decrypted upload differs from the file")
+		}
+
+		mu.Lock()
+		keys = append(keys, r.Header.Get(HeaderEncryptionKey))
+		first := len(keys) == 1
+		mu.Unlock()
+		if first {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	remote := config.RemoteConfig{Name: "sealed-retry", Endpoint: srv.URL, Key: "k", EncryptTo: keyFile,
+		ContentMD5: true, RetryAttempts: 2, RetryBaseDelay: "1ms"}
+	var plainSum string
+	var failure error
+	UploadFile(t.Context(), remote, path, time.Now().UnixNano(),
+		func(_ string, hash string, _ int64, _ Receipt) { plainSum = hash },
+		func(_ string, err error) { failure = err }, nil)
+	if failure != nil {
+		t.Fatal(failure)
+	}
+
+	if len(keys) != 2 || keys[0] == keys[1] {
+		t.Fatalf("%d attempts, data keys reused: %v", len(keys), len(keys) == 2 && keys[0] == keys[1])
+	}
+	sum := sha256.Sum256(content)
+	if plainSum != hex.EncodeToString(sum[:]) {
+		t.Fatalf("reported %s, want the plaintext sha256", plainSum)
+	}
+}
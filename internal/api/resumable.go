@@ -0,0 +1,290 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/cleverdata/sift-agent/internal/db"
+	"github.com/dustin/go-humanize"
+	"github.com/go-resty/resty/v2"
+)
+
+// Resumable uploads for servers advertising CapResumable. The protocol is
+// described in docs/resumable-uploads.md.
+
+const (
+	defaultChunkThreshold = 64 << 20
+	defaultChunkSize      = 8 << 20
+)
+
+var errSessionGone = errors.New("upload session no longer exists")
+
+type sessionResponse struct {
+	SessionID string `json:"session_id"`
+	Offset    int64  `json:"offset"`
+}
+
+// chunkThreshold returns the file size above which the remote uses resumable
+// uploads, or 0 when they are disabled.
+func chunkThreshold(remote config.RemoteConfig) int64 {
+	return parseSize(remote.ChunkThreshold, defaultChunkThreshold)
+}
+
+// chunkSize returns the remote's chunk size, at most config.MaxChunkSize.
+func chunkSize(remote config.RemoteConfig) int64 {
+	n := parseSize(remote.ChunkSize, defaultChunkSize)
+	if n <= 0 {
+		return defaultChunkSize
+	}
+	return min(n, config.MaxChunkSize)
+}
+
+// validateChunkSize rejects a chunk_size above config.MaxChunkSize.
+func validateChunkSize(remote config.RemoteConfig) error {
+	if n := parseSize(remote.ChunkSize, defaultChunkSize); n > config.MaxChunkSize {
+		return fmt.Errorf("remote %s: chunk_size %s is above the maximum of %s", remote.Name, remote.ChunkSize, humanize.IBytes(config.MaxChunkSize))
+	}
+	return nil
+}
+
+func parseSize(s string, def int64) int64 {
+	if s == "" {
+		return def
+	}
+	n, err := humanize.ParseBytes(s)
+	if err != nil {
+		return def
+	}
+	return int64(n)
+}
+
+// uploadResumable sends the file in fixed-size chunks, resuming any session
+// previously persisted for it. The session is kept on failure so the next
+// attempt continues from the last acknowledged chunk.
+func uploadResumable(ctx context.Context, client *resty.Client, remote config.RemoteConfig, filePath string, digest uploadDigest, modTime int64,
+	logger func(string, ...interface{})) (Receipt, error) {
+
+	session, err := resumeOrCreateSession(ctx, client, remote, filePath, digest, modTime)
+	if err != nil {
+		return Receipt{}, err
+	}
+	if session.Offset > 0 && logger != nil {
+		logger("[%s] Resuming upload of %s at %s of %s", remote.Name, filepath.Base(filePath),
+			humanize.IBytes(uint64(session.Offset)), humanize.IBytes(uint64(session.Size)))
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return Receipt{}, err
+	}
+	defer f.Close()
+
+	sniff := make([]byte, sniffLen)
+	n, _ := f.ReadAt(sniff, 0)
+	encoding := chooseEncoding(remote, filepath.Base(filePath), http.DetectContentType(sniff[:n]))
+	var rawBytes, wireBytes int64
+
+	// Consecutive chunk failures follow the remote's retry policy. Progress
+	// resets the count, so a long upload survives many separate drops.
+	policy := retryPolicyFor(remote)
+	buf := make([]byte, min(session.ChunkSize, config.MaxChunkSize))
+	failures := 0
+	for session.Offset < session.Size {
+		n, err := f.ReadAt(buf, session.Offset)
+		if err != nil && err != io.EOF {
+			return Receipt{}, err
+		}
+
+		acked, wire, err := putChunk(ctx, client, remote, session, buf[:n], encoding)
+		if err == errSessionGone {
+			db.DeleteUploadSession(filePath)
+			return Receipt{}, err
+		}
+		if err == nil && acked <= session.Offset {
+			// A resync that does not move forward counts as a failed attempt,
+			// so a server that keeps answering 409 cannot spin this loop
+			err = fmt.Errorf("server resynced to offset %d", acked)
+			session.Offset = acked
+			db.SaveUploadSession(session)
+		}
+		if err != nil {
+			uerr := Classify(err)
+			wait, retry := policy.next(uerr, failures)
+			failures++
+			if !retry || failures >= policy.attempts {
+				uerr.Err = fmt.Errorf("chunk at offset %d: %w", session.Offset, uerr.Err)
+				return Receipt{}, uerr
+			}
+			if !sleepCtx(ctx, wait) {
+				return Receipt{}, ctx.Err()
+			}
+			continue
+		}
+
+		failures = 0
+		if wire > 0 {
+			rawBytes += int64(n)
+			wireBytes += wire
+		}
+		session.Offset = acked
+		db.SaveUploadSession(session)
+	}
+
+	var receipt Receipt
+	resp, err := client.R().
+		SetContext(ctx).
+		SetBody(map[string]interface{}{"sha256": digest.sha256}).
+		SetResult(&receipt).
+		Post(fmt.Sprintf("%s/agent/uploads/%s/complete", remote.Endpoint, url.PathEscape(session.SessionID)))
+	if err != nil {
+		return Receipt{}, err
+	}
+	if resp.StatusCode() == 404 {
+		db.DeleteUploadSession(filePath)
+		return Receipt{}, errSessionGone
+	}
+	if resp.StatusCode() < 200 || resp.StatusCode() >= 300 {
+		return Receipt{}, statusError(resp, "finalize failed")
+	}
+
+	db.DeleteUploadSession(filePath)
+	if encoding != "" {
+		receipt.Encoding = encoding
+		receipt.RawBytes = rawBytes
+		receipt.WireBytes = wireBytes
+		recordCompression(remote, encoding, rawBytes, wireBytes)
+	}
+	return receipt, nil
+}
+
+func resumeOrCreateSession(ctx context.Context, client *resty.Client, remote config.RemoteConfig, filePath string, digest uploadDigest, modTime int64) (db.UploadSession, error) {
+	if s, ok := db.GetUploadSession(filePath); ok {
+		if s.Endpoint == remote.Endpoint && s.Hash == digest.sha256 && s.Size == digest.size && s.ModTime == modTime {
+			var state sessionResponse
+			resp, err := client.R().
+				SetContext(ctx).
+				SetResult(&state).
+				Get(fmt.Sprintf("%s/agent/uploads/%s", remote.Endpoint, url.PathEscape(s.SessionID)))
+			if err != nil {
+				return db.UploadSession{}, err
+			}
+			if resp.StatusCode() == 200 && state.Offset >= 0 && state.Offset <= s.Size {
+				s.Offset = state.Offset
+				return s, nil
+			}
+		}
+		// File changed or the server dropped the session. Start over.
+		db.DeleteUploadSession(filePath)
+	}
+
+	chunk := chunkSize(remote)
+
+	var created sessionResponse
+	resp, err := client.R().
+		SetContext(ctx).
+		SetBody(map[string]interface{}{
+			"filename":   filepath.Base(filePath),
+			"size":       digest.size,
+			"sha256":     digest.sha256,
+			"mod_time":   time.Unix(0, modTime).UTC().Format(time.RFC3339Nano),
+			"chunk_size": chunk,
+		}).
+		SetResult(&created).
+		Post(remote.Endpoint + "/agent/uploads")
+	if err != nil {
+		return db.UploadSession{}, err
+	}
+	if resp.StatusCode() < 200 || resp.StatusCode() >= 300 {
+		return db.UploadSession{}, statusError(resp, "session create failed")
+	}
+	if created.SessionID == "" {
+		return db.UploadSession{}, errors.New("session create failed: no session_id in response")
+	}
+	if created.Offset < 0 || created.Offset > digest.size {
+		return db.UploadSession{}, fmt.Errorf("session create failed: server reported invalid offset %d", created.Offset)
+	}
+
+	s := db.UploadSession{
+		FilePath:  filePath,
+		Endpoint:  remote.Endpoint,
+		SessionID: created.SessionID,
+		Hash:      digest.sha256,
+		Size:      digest.size,
+		ModTime:   modTime,
+		ChunkSize: chunk,
+		Offset:    created.Offset,
+	}
+	db.SaveUploadSession(s)
+	return s, nil
+}
+
+// putChunk sends one chunk, compressed with encoding when set, and returns the
+// offset the server acknowledged and the number of bytes sent. Offsets and the
+// chunk digest always refer to the uncompressed file.
+func putChunk(ctx context.Context, client *resty.Client, remote config.RemoteConfig, s db.UploadSession, chunk []byte, encoding string) (int64, int64, error) {
+	sum := sha256.Sum256(chunk)
+	end := s.Offset + int64(len(chunk)) - 1
+
+	payload := chunk
+	if encoding != "" {
+		var err error
+		if payload, err = compressChunk(chunk, encoding); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	idle := idleTimeout(remote)
+	reqCtx, stop := watchIdle(ctx, bytes.NewReader(payload), idle)
+	defer stop()
+
+	req := client.R().
+		SetContext(reqCtx).
+		SetHeader("Content-Type", "application/octet-stream").
+		SetHeader("Content-Range", fmt.Sprintf("bytes %d-%d/%d", s.Offset, end, s.Size)).
+		SetHeader("X-Sift-Chunk-SHA256", hex.EncodeToString(sum[:])).
+		SetQueryParam("offset", strconv.FormatInt(s.Offset, 10)).
+		SetHeader("Content-Length", strconv.Itoa(len(payload)))
+	if encoding != "" {
+		req.SetHeader("Content-Encoding", encoding)
+	}
+	if signs(remote) {
+		req.SetHeader(HeaderBodySHA256, hex.EncodeToString(sum[:]))
+	}
+
+	resp, err := req.Put(fmt.Sprintf("%s/agent/uploads/%s", remote.Endpoint, url.PathEscape(s.SessionID)))
+	if err != nil {
+		return 0, 0, idleError(reqCtx, err, idle)
+	}
+	var ack sessionResponse
+	json.Unmarshal(resp.Body(), &ack) // 409 carries the offset too
+
+	switch {
+	case resp.StatusCode() == 404:
+		return 0, 0, errSessionGone
+	case resp.StatusCode() == 409:
+		// Offset mismatch. The server reports where it actually is, the caller
+		// treats an offset that did not advance as a failed attempt.
+		if ack.Offset < 0 || ack.Offset > s.Size {
+			return 0, 0, fmt.Errorf("server reported invalid offset %d", ack.Offset)
+		}
+		return ack.Offset, 0, nil
+	case resp.StatusCode() < 200 || resp.StatusCode() >= 300:
+		return 0, 0, statusError(resp, "chunk rejected")
+	case ack.Offset <= s.Offset || ack.Offset > s.Size:
+		return 0, 0, fmt.Errorf("server acknowledged invalid offset %d", ack.Offset)
+	}
+	return ack.Offset, int64(len(payload)), nil
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/cleverdata/sift-agent/internal/db"
+	"github.com/go-resty/resty/v2"
+)
+
+func TestChunkSizeIsBounded(t *testing.T) {
+	for value, want := range map[string]int64{
+		"":       defaultChunkSize,
+		"1MiB":   1 << 20,
+		"256MiB": config.MaxChunkSize,
+		"64GiB":  config.MaxChunkSize,
+	} {
+		if got := chunkSize(config.RemoteConfig{ChunkSize: value}); got != want {
+			t.Errorf("chunk_size %q used as %d, want %d", value, got, want)
+		}
+	}
+	if _, err := UploaderFor(config.RemoteConfig{Name: "big", Endpoint: "http://sift", Key: "k", ChunkSize: "1GiB"}); err == nil {
+		t.Fatal("chunk_size above the maximum accepted")
+	}
+}
+
+func TestSessionOffsetOutOfRange(t *testing.T) {
+	if err := db.Init(filepath.Join(t.TempDir(), "state.db")); err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []int64{-1, 101} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"session_id":"s-1","offset":%d}`, offset)
+		}))
+		remote := config.RemoteConfig{Name: "offsets", Endpoint: srv.URL}
+		_, err := resumeOrCreateSession(context.Background(), resty.New(), remote, "/data/scan.pdf",
+			uploadDigest{sha256: "abc", size: 100}, time.Now().UnixNano())
+		srv.Close()
+		if err == nil {
+			t.Fatalf("session created at offset %d of 100", offset)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/go-resty/resty/v2"
+)
+
+// ErrorClass tells the caller how to react to a failed upload.
+type ErrorClass int
+
+const (
+	ClassTransient ErrorClass = iota // Network errors, 5xx, digest mismatches: retry with backoff
+	ClassThrottled                   // 429 or 503 with Retry-After: wait as instructed
+	ClassAuth                        // 401/403: retrying with the same key will not help
+	ClassPermanent                   // Other 4xx such as 400, 413, 415: the file itself is rejected
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ClassThrottled:
+		return "throttled"
+	case ClassAuth:
+		return "auth"
+	case ClassPermanent:
+		return "permanent"
+	default:
+		return "transient"
+	}
+}
+
+// UploadError is a classified upload failure.
+type UploadError struct {
+	Class      ErrorClass
+	Status     int           // HTTP status, 0 for transport errors
+	RetryAfter time.Duration // Server-requested wait, if any
+	Timeout    string        // Kind of timeout ("connect", "idle transfer", ...), if the failure was one
+	Err        error
+}
+
+func (e *UploadError) Error() string {
+	if e.Status != 0 {
+		return fmt.Sprintf("%s error (status %d): %v", e.Class, e.Status, e.Err)
+	}
+	if e.Timeout != "" {
+		return fmt.Sprintf("%s error: %s timeout: %v", e.Class, e.Timeout, e.Err)
+	}
+	return fmt.Sprintf("%s error: %v", e.Class, e.Err)
+}
+
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+// Classify returns err as an *UploadError, treating unclassified errors as
+// transient.
+func Classify(err error) *UploadError {
+	var uerr *UploadError
+	if errors.As(err, &uerr) {
+		return uerr
+	}
+	return &UploadError{Class: ClassTransient, Timeout: timeoutKind(err), Err: err}
+}
+
+// statusError classifies a non-2xx response.
+func statusError(resp *resty.Response, what string) *UploadError {
+	code := resp.StatusCode()
+	e := &UploadError{Status: code, Err: fmt.Errorf("%s: %s", what, resp.Status())}
+	retryAfter := parseRetryAfter(resp.Header().Get("Retry-After"))
+
+	switch {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		e.Class = ClassAuth
+	case code == http.StatusTooManyRequests || (code == http.StatusServiceUnavailable && retryAfter > 0):
+		e.Class = ClassThrottled
+		e.RetryAfter = retryAfter
+	case code == http.StatusRequestTimeout || code == http.StatusTooEarly || code >= 500:
+		e.Class = ClassTransient
+	default:
+		e.Class = ClassPermanent
+	}
+	return e
+}
+
+// parseRetryAfter accepts both forms allowed by RFC 9110: delay-seconds and
+// an HTTP date.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+type retryPolicy struct {
+	endpoint string
+	attempts int
+	base     time.Duration
+	max      time.Duration
+}
+
+func retryPolicyFor(remote config.RemoteConfig) retryPolicy {
+	p := retryPolicy{endpoint: remote.Endpoint, attempts: remote.RetryAttempts, base: 2 * time.Second, max: time.Minute}
+	if p.attempts <= 0 {
+		p.attempts = 3
+	}
+	if d, err := time.ParseDuration(remote.RetryBaseDelay); err == nil && d > 0 {
+		p.base = d
+	}
+	if d, err := time.ParseDuration(remote.RetryMaxDelay); err == nil && d > 0 {
+		p.max = d
+	}
+	if p.max < p.base {
+		p.max = p.base
+	}
+	return p
+}
+
+// delay returns the exponential backoff before retry n (0-based), with equal
+// jitter so agents that failed together do not retry in lockstep.
+func (p retryPolicy) delay(n int) time.Duration {
+	d := p.max
+	if n < 30 {
+		if exp := p.base << n; exp > 0 && exp < p.max {
+			d = exp
+		}
+	}
+	half := d / 2
+	return half + rand.N(half+1)
+}
+
+// next decides whether a failure is worth another attempt and how long to wait
+// first. Throttling longer than the backoff ceiling is handed back to the
+// caller instead of holding a worker slot, and so is any failure once the
+// endpoint's circuit breaker has opened.
+func (p retryPolicy) next(uerr *UploadError, n int) (time.Duration, bool) {
+	switch uerr.Class {
+	case ClassAuth, ClassPermanent:
+		return 0, false
+	case ClassTransient:
+		if BreakerState(p.endpoint) == BreakerOpen {
+			return 0, false
+		}
+	case ClassThrottled:
+		if uerr.RetryAfter > p.max {
+			return 0, false
+		}
+		if uerr.RetryAfter > 0 {
+			return uerr.RetryAfter, true
+		}
+	}
+	return p.delay(n), true
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
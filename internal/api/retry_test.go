@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/go-resty/resty/v2"
+)
+
+func response(code int, retryAfter string) *resty.Response {
+	header := make(http.Header)
+	if retryAfter != "" {
+		header.Set("Retry-After", retryAfter)
+	}
+	return &resty.Response{RawResponse: &http.Response{StatusCode: code, Status: http.StatusText(code), Header: header}}
+}
+
+func TestStatusErrorClass(t *testing.T) {
+	for _, tc := range []struct {
+		code       int
+		retryAfter string
+		class      ErrorClass
+	}{
+		{400, "", ClassPermanent},
+		{401, "", ClassAuth},
+		{403, "", ClassAuth},
+		{404, "", ClassPermanent},
+		{408, "", ClassTransient},
+		{413, "", ClassPermanent},
+		{415, "", ClassPermanent},
+		{422, "", ClassPermanent},
+		{425, "", ClassTransient},
+		{429, "", ClassThrottled},
+		{500, "", ClassTransient},
+		{502, "", ClassTransient},
+		{503, "", ClassTransient},
+		{503, "30", ClassThrottled},
+		{504, "", ClassTransient},
+	} {
+		uerr := statusError(response(tc.code, tc.retryAfter), "upload failed")
+		if uerr.Class != tc.class || uerr.Status != tc.code {
+			t.Errorf("%d (Retry-After %q) classified as %s, want %s", tc.code, tc.retryAfter, uerr.Class, tc.class)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	rejected := &UploadError{Class: ClassPermanent, Err: errors.New("rejected")}
+	if got := Classify(fmt.Errorf("sending: %w", rejected)); got != rejected {
+		t.Fatalf("wrapped upload error classified as %v", got)
+	}
+	if got := Classify(errors.New("connection reset")); got.Class != ClassTransient {
+		t.Fatalf("plain error classified as %s", got.Class)
+	}
+	if got := Classify(context.DeadlineExceeded); got.Class != ClassTransient {
+		t.Fatalf("timeout classified as %s", got.Class)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	if d := statusError(response(429, "120"), "throttled").RetryAfter; d != 2*time.Minute {
+		t.Fatalf("Retry-After in seconds read as %s", d)
+	}
+	date := time.Now().Add(90 * time.Second).UTC().Format(http.TimeFormat)
+	if d := statusError(response(429, date), "throttled").RetryAfter; d < 85*time.Second || d > 90*time.Second {
+		t.Fatalf("Retry-After as HTTP date read as %s", d)
+	}
+	for _, v := range []string{"", "0", "-5", "soon", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)} {
+		if d := parseRetryAfter(v); d != 0 {
+			t.Errorf("Retry-After %q read as %s", v, d)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := retryPolicyFor(config.RemoteConfig{Endpoint: "http://backoff", RetryBaseDelay: "1s", RetryMaxDelay: "10s"})
+	for n, ceiling := range []time.Duration{1, 2, 4, 8, 10, 10, 10} {
+		ceiling *= time.Second
+		for i := 0; i < 200; i++ {
+			// Equal jitter: between half the backoff and the backoff
+			if d := p.delay(n); d < ceiling/2 || d > ceiling {
+				t.Fatalf("retry %d waits %s, want %s to %s", n, d, ceiling/2, ceiling)
+			}
+		}
+	}
+	if d := p.delay(100); d < 5*time.Second || d > 10*time.Second {
+		t.Fatalf("overflowing retry waits %s", d)
+	}
+
+	// Throttling within the cap is honoured as requested, beyond it handed back
+	if d, ok := p.next(&UploadError{Class: ClassThrottled, RetryAfter: 7 * time.Second}, 0); !ok || d != 7*time.Second {
+		t.Fatalf("Retry-After of 7s waits %s, retry %v", d, ok)
+	}
+	if _, ok := p.next(&UploadError{Class: ClassThrottled, RetryAfter: time.Minute}, 0); ok {
+		t.Fatal("Retry-After above the cap held the worker")
+	}
+	for _, class := range []ErrorClass{ClassAuth, ClassPermanent} {
+		if _, ok := p.next(&UploadError{Class: class}, 0); ok {
+			t.Fatalf("%s error retried", class)
+		}
+	}
+}
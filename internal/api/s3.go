@@ -0,0 +1,466 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/go-resty/resty/v2"
+)
+
+// S3-compatible destination, path-style and signed with AWS Signature Version 4.
+// The requests and object metadata are listed in docs/destinations.md.
+const (
+	s3DefaultRegion = "us-east-1"
+	s3MinPartSize   = 5 << 20
+	s3MaxParts      = 10000
+	s3EmptyHash     = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+type s3Uploader struct{}
+
+func (s3Uploader) Upload(ctx context.Context, remote config.RemoteConfig, filePath string, modTime int64,
+	onSuccess func(string, string, int64, Receipt), onError func(string, error), logger func(string, ...interface{})) {
+
+	client, err := clientFor(remote)
+	if err != nil {
+		if logger != nil {
+			logger("[%s] Cannot upload %s: %v", remote.Name, filepath.Base(filePath), err)
+		}
+		failLocal(filePath, err, onError)
+		return
+	}
+	fileName := filepath.Base(filePath)
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		failLocal(filePath, err, onError)
+		return
+	}
+	hash := contentHash(ctx)
+	if hash == "" {
+		if hash, err = HashFile(filePath); err != nil {
+			failLocal(filePath, err, onError)
+			return
+		}
+	}
+
+	key := strings.TrimPrefix(destinationKey(remote, filePath, time.Now()), "/")
+	meta := map[string]string{
+		"X-Amz-Meta-Sha256":   hash,
+		"X-Amz-Meta-Mod-Time": time.Unix(0, modTime).UTC().Format(time.RFC3339Nano),
+	}
+
+	var ok bool
+	var lastErr *UploadError
+	threshold := chunkThreshold(remote)
+	if threshold > 0 && info.Size() >= threshold {
+		ok, lastErr = s3Multipart(ctx, client, remote, filePath, key, hash, info.Size(), meta, logger)
+	} else {
+		ok, lastErr = withRetries(ctx, remote, fileName, logger, func() error {
+			return s3Put(ctx, client, remote, filePath, key, hash, info.Size(), meta)
+		})
+	}
+
+	if ok {
+		if onSuccess != nil {
+			onSuccess(filePath, hash, modTime, Receipt{DocumentID: "s3://" + remote.Bucket + "/" + key, SHA256: hash, Size: info.Size()})
+		}
+		return
+	}
+	if onError != nil && lastErr != nil {
+		onError(filePath, lastErr)
+	}
+}
+
+// Check confirms the bucket exists and the credentials may access it.
+func (s3Uploader) Check(ctx context.Context, remote config.RemoteConfig) error {
+	client, err := NewClient(remote)
+	if err != nil {
+		return err
+	}
+	client.SetPreRequestHook(s3Signer(remote))
+	resp, err := client.R().
+		SetContext(ctx).
+		SetHeader("X-Amz-Content-Sha256", s3EmptyHash).
+		Head(s3URL(remote, ""))
+	if err != nil {
+		return Classify(err)
+	}
+	if resp.StatusCode() == 404 {
+		return &UploadError{Class: ClassPermanent, Status: 404, Err: fmt.Errorf("bucket %s not found", remote.Bucket)}
+	}
+	if resp.StatusCode() != 200 {
+		return s3Error(resp, "bucket check failed")
+	}
+	return nil
+}
+
+// s3Put uploads the file in a single request, streaming it from disk. S3
+// rejects the body if it no longer matches the signed hash.
+func s3Put(ctx context.Context, client *resty.Client, remote config.RemoteConfig, filePath string, key string, hash string, size int64, meta map[string]string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	idle := idleTimeout(remote)
+	reqCtx, stop := watchIdle(ctx, f, idle)
+	defer stop()
+
+	resp, err := client.R().
+		SetContext(reqCtx).
+		SetHeaders(meta).
+		SetHeader("Content-Type", "application/octet-stream").
+		SetHeader("Content-Length", strconv.FormatInt(size, 10)).
+		SetHeader("X-Amz-Content-Sha256", hash).
+		Put(s3URL(remote, key))
+	if err != nil {
+		return idleError(reqCtx, err, idle)
+	}
+	if resp.StatusCode() != 200 {
+		return s3Error(resp, "upload rejected")
+	}
+	return nil
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// s3Multipart uploads the file in parts, each retried on its own. A failed
+// upload is aborted so the bucket does not keep the orphaned parts.
+func s3Multipart(ctx context.Context, client *resty.Client, remote config.RemoteConfig, filePath string, key string, hash string, size int64,
+	meta map[string]string, logger func(string, ...interface{})) (bool, *UploadError) {
+
+	fileName := filepath.Base(filePath)
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false, Classify(err)
+	}
+	defer f.Close()
+
+	var uploadID string
+	ok, lastErr := withRetries(ctx, remote, fileName, logger, func() error {
+		var err error
+		uploadID, err = s3CreateMultipart(ctx, client, remote, key, meta)
+		return err
+	})
+	if !ok {
+		return false, lastErr
+	}
+
+	abort := func() {
+		// The agent may be shutting down, so the abort gets its own deadline
+		abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		client.R().
+			SetContext(abortCtx).
+			SetHeader("X-Amz-Content-Sha256", s3EmptyHash).
+			SetQueryParam("uploadId", uploadID).
+			Delete(s3URL(remote, key))
+	}
+
+	partSize := s3PartSize(remote, size)
+	buf := make([]byte, partSize)
+	sent := sha256.New()
+	var parts []s3Part
+	for offset, number := int64(0), 1; offset < size; offset, number = offset+partSize, number+1 {
+		n, err := f.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			abort()
+			return false, Classify(err)
+		}
+		chunk := buf[:n]
+		sent.Write(chunk)
+
+		var etag string
+		label := fmt.Sprintf("%s part %d", fileName, number)
+		ok, lastErr := withRetries(ctx, remote, label, logger, func() error {
+			var err error
+			etag, err = s3PutPart(ctx, client, remote, key, uploadID, number, chunk)
+			return err
+		})
+		if !ok {
+			abort()
+			return false, lastErr
+		}
+		parts = append(parts, s3Part{PartNumber: number, ETag: etag})
+	}
+
+	if got := hex.EncodeToString(sent.Sum(nil)); got != hash {
+		abort()
+		return false, &UploadError{Class: ClassTransient, Err: fmt.Errorf("file changed while uploading: hashed sha256 %s, sent %s", hash, got)}
+	}
+
+	ok, lastErr = withRetries(ctx, remote, fileName, logger, func() error {
+		return s3CompleteMultipart(ctx, client, remote, key, uploadID, parts)
+	})
+	if !ok {
+		abort()
+	}
+	return ok, lastErr
+}
+
+func s3CreateMultipart(ctx context.Context, client *resty.Client, remote config.RemoteConfig, key string, meta map[string]string) (string, error) {
+	resp, err := client.R().
+		SetContext(ctx).
+		SetHeaders(meta).
+		SetHeader("Content-Type", "application/octet-stream").
+		SetHeader("X-Amz-Content-Sha256", s3EmptyHash).
+		SetQueryParam("uploads", "").
+		Post(s3URL(remote, key))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode() != 200 {
+		return "", s3Error(resp, "multipart upload rejected")
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp.Body(), &result); err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("invalid multipart upload response: %q", resp.String())
+	}
+	return result.UploadID, nil
+}
+
+func s3PutPart(ctx context.Context, client *resty.Client, remote config.RemoteConfig, key string, uploadID string, number int, chunk []byte) (string, error) {
+	sum := sha256.Sum256(chunk)
+	idle := idleTimeout(remote)
+	reqCtx, stop := watchIdle(ctx, bytes.NewReader(chunk), idle)
+	defer stop()
+
+	resp, err := client.R().
+		SetContext(reqCtx).
+		SetHeader("Content-Length", strconv.Itoa(len(chunk))).
+		SetHeader("X-Amz-Content-Sha256", hex.EncodeToString(sum[:])).
+		SetQueryParam("partNumber", strconv.Itoa(number)).
+		SetQueryParam("uploadId", uploadID).
+		Put(s3URL(remote, key))
+	if err != nil {
+		return "", idleError(reqCtx, err, idle)
+	}
+	if resp.StatusCode() != 200 {
+		return "", s3Error(resp, "part rejected")
+	}
+	etag := resp.Header().Get("ETag")
+	if etag == "" {
+		return "", errors.New("part accepted without an ETag")
+	}
+	return etag, nil
+}
+
+func s3CompleteMultipart(ctx context.Context, client *resty.Client, remote config.RemoteConfig, key string, uploadID string, parts []s3Part) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+
+	resp, err := client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/xml").
+		SetHeader("X-Amz-Content-Sha256", hex.EncodeToString(sum[:])).
+		SetQueryParam("uploadId", uploadID).
+		SetBody(body).
+		Post(s3URL(remote, key))
+	if err != nil {
+		return err
+	}
+	// A completion that fails after the 200 has been sent reports the error in
+	// the body
+	if resp.StatusCode() != 200 || bytes.Contains(resp.Body(), []byte("<Error>")) {
+		e := s3Error(resp, "multipart completion failed")
+		if resp.StatusCode() == 200 {
+			e.Class = ClassTransient
+		}
+		return e
+	}
+	return nil
+}
+
+// s3PartSize returns chunk_size raised to the S3 minimum part size, and
+// further as needed to stay within the part count limit.
+func s3PartSize(remote config.RemoteConfig, size int64) int64 {
+	partSize := max(chunkSize(remote), s3MinPartSize)
+	if size/partSize >= s3MaxParts {
+		partSize = size/(s3MaxParts-1) + 1
+	}
+	return partSize
+}
+
+// s3Error classifies a failed S3 response, adding the error code from the
+// XML body.
+func s3Error(resp *resty.Response, what string) *UploadError {
+	e := statusError(resp, what)
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(resp.Body(), &body) != nil || body.Code == "" {
+		return e
+	}
+	e.Err = fmt.Errorf("%s: %s: %s: %s", what, resp.Status(), body.Code, body.Message)
+	switch body.Code {
+	case "SlowDown":
+		e.Class = ClassThrottled
+	case "XAmzContentSHA256Mismatch", "BadDigest", "RequestTimeTooSkewed":
+		// The file changed under the upload or the clock drifted, neither of
+		// which makes the file itself unacceptable
+		e.Class = ClassTransient
+	}
+	return e
+}
+
+func s3URL(remote config.RemoteConfig, key string) string {
+	u := remote.Endpoint + "/" + s3Escape(remote.Bucket, false)
+	if key != "" {
+		u += "/" + s3Escape(key, true)
+	}
+	return u
+}
+
+func s3Credentials(remote config.RemoteConfig) (accessKey, secretKey, sessionToken string) {
+	if remote.AccessKey != "" {
+		return remote.AccessKey, remote.SecretKey, ""
+	}
+	return os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")
+}
+
+// s3Signer returns a pre-request hook that streams the body like streamBody
+// and signs the final request.
+func s3Signer(remote config.RemoteConfig) func(*resty.Client, *http.Request) error {
+	region := remote.Region
+	if region == "" {
+		region = s3DefaultRegion
+	}
+	return func(c *resty.Client, req *http.Request) error {
+		if err := streamBody(c, req); err != nil {
+			return err
+		}
+		accessKey, secretKey, token := s3Credentials(remote)
+		if accessKey == "" || secretKey == "" {
+			return &UploadError{Class: ClassAuth, Err: errors.New("no S3 credentials: set access_key and secret_key or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")}
+		}
+		if token != "" {
+			req.Header.Set("X-Amz-Security-Token", token)
+		}
+		signV4(req, accessKey, secretKey, region, "s3", time.Now())
+		return nil
+	}
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header covering the
+// host and all x-amz-* headers. X-Amz-Content-Sha256 must already be set.
+func signV4(req *http.Request, accessKey, secretKey, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = "UNSIGNED-PAYLOAD"
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// The request goes out exactly as it is signed
+	req.URL.RawPath = s3Escape(req.URL.Path, true)
+	req.URL.RawQuery = canonicalQuery(req.URL.Query())
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.RawPath,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(values map[string][]string) string {
+	var pairs []string
+	for k, vs := range values {
+		for _, v := range vs {
+			pairs = append(pairs, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent-encodes everything but the RFC 3986 unreserved characters,
+// and slashes when keepSlash is set, as Signature Version 4 requires.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && keepSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
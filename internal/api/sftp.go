@@ -0,0 +1,412 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTP destination. Files are written under a hidden temporary name and renamed
+// into place; docs/destinations.md describes when the rename is atomic.
+
+// A remote's workers share one SSH connection, each transfer on an SFTP
+// session of its own, so aborting one transfer leaves the others running.
+var (
+	sftpMu    sync.Mutex
+	sftpConns = make(map[string]*ssh.Client)
+)
+
+// sftpConnFor returns the remote's open SSH connection, connecting if needed.
+func sftpConnFor(ctx context.Context, remote config.RemoteConfig) (*ssh.Client, bool, error) {
+	sftpMu.Lock()
+	defer sftpMu.Unlock()
+	if c, ok := sftpConns[remote.Name]; ok {
+		return c, true, nil
+	}
+	c, err := sftpDial(ctx, remote)
+	if err != nil {
+		return nil, false, err
+	}
+	sftpConns[remote.Name] = c
+	return c, false, nil
+}
+
+// dropConn closes a connection that failed, so the next transfer reconnects.
+func dropConn(remote config.RemoteConfig, c *ssh.Client) {
+	sftpMu.Lock()
+	if sftpConns[remote.Name] == c {
+		delete(sftpConns, remote.Name)
+	}
+	sftpMu.Unlock()
+	c.Close()
+}
+
+// sftpSessionFor opens an SFTP session for one transfer. A shared connection
+// that can no longer open sessions has died and is replaced once.
+func sftpSessionFor(ctx context.Context, remote config.RemoteConfig) (*sftp.Client, error) {
+	for {
+		conn, shared, err := sftpConnFor(ctx, remote)
+		if err != nil {
+			return nil, err
+		}
+		s, err := openSession(ctx, conn, durationOr(remote.ResponseTimeout, defaultResponseTimeout))
+		if err == nil || ctx.Err() != nil {
+			return s, err
+		}
+		dropConn(remote, conn)
+		if !shared {
+			return nil, err
+		}
+	}
+}
+
+// openSession starts the SFTP subsystem on conn. A half-open connection never
+// answers, so the wait is bounded and the caller drops the connection.
+func openSession(ctx context.Context, conn *ssh.Client, timeout time.Duration) (*sftp.Client, error) {
+	type result struct {
+		s   *sftp.Client
+		err error
+	}
+	opened := make(chan result, 1)
+	go func() {
+		s, err := sftp.NewClient(conn)
+		opened <- result{s, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-opened:
+		return r.s, r.err
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	go func() {
+		if r := <-opened; r.s != nil {
+			r.s.Close()
+		}
+	}()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, fmt.Errorf("no sftp session after %s", timeout)
+}
+
+// sftpEndpoint parses the endpoint into the user and the host:port to dial
+// and to look up in known_hosts, with port 22 by default.
+func sftpEndpoint(remote config.RemoteConfig) (string, string, error) {
+	u, err := url.Parse(remote.Endpoint)
+	if err != nil || u.Scheme != "sftp" || u.Hostname() == "" || u.User.Username() == "" {
+		return "", "", fmt.Errorf("invalid sftp endpoint %q: expected sftp://user@host[:port]", remote.Endpoint)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "22"
+	}
+	return u.User.Username(), net.JoinHostPort(u.Hostname(), port), nil
+}
+
+func sftpDial(ctx context.Context, remote config.RemoteConfig) (*ssh.Client, error) {
+	user, addr, err := sftpEndpoint(remote)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := sftpAuth(remote)
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, algorithms, err := sftpHostKeys(remote, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := net.Dialer{Timeout: durationOr(remote.ConnectTimeout, defaultConnectTimeout)}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// The SSH handshake gets the same budget as a TLS handshake
+	conn.SetDeadline(time.Now().Add(durationOr(remote.TLSTimeout, defaultTLSTimeout)))
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+		User:              user,
+		Auth:              auth,
+		HostKeyCallback:   hostKeys,
+		HostKeyAlgorithms: algorithms,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// sftpAuth offers the private key, if any, then the password. The password
+// doubles as the passphrase of an encrypted key.
+func sftpAuth(remote config.RemoteConfig) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	if remote.PrivateKey != "" {
+		pem, err := os.ReadFile(remote.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read private key: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) && remote.Password != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(remote.Password))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load private key: %w", err)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	if remote.Password != "" {
+		methods = append(methods, ssh.Password(remote.Password))
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("sftp remote needs a password or private_key")
+	}
+	return methods, nil
+}
+
+// sftpHostKeys returns the known_hosts check for addr, and the host key
+// algorithms to negotiate: only the types known for the host, so that a
+// server with several host keys presents one that can be verified.
+func sftpHostKeys(remote config.RemoteConfig, addr string) (ssh.HostKeyCallback, []string, error) {
+	file := remote.KnownHosts
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil, fmt.Errorf("no known_hosts configured: %w", err)
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read known_hosts: %w", err)
+	}
+
+	var algorithms []string
+	var keyErr *knownhosts.KeyError
+	if errors.As(callback(addr, &net.TCPAddr{IP: net.IPv4zero}, probeKey{}), &keyErr) {
+		for _, k := range keyErr.Want {
+			if k.Key.Type() == ssh.KeyAlgoRSA {
+				algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+			}
+			algorithms = append(algorithms, k.Key.Type())
+		}
+	}
+	return callback, algorithms, nil
+}
+
+// probeKey matches no host key, so checking it lists the known keys.
+type probeKey struct{}
+
+func (probeKey) Type() string                                 { return "probe" }
+func (probeKey) Marshal() []byte                              { return []byte("probe") }
+func (probeKey) Verify(data []byte, sig *ssh.Signature) error { return errors.New("probe key") }
+
+type sftpUploader struct{}
+
+func (sftpUploader) Upload(ctx context.Context, remote config.RemoteConfig, filePath string, modTime int64,
+	onSuccess func(string, string, int64, Receipt), onError func(string, error), logger func(string, ...interface{})) {
+
+	fileName := filepath.Base(filePath)
+	info, err := os.Stat(filePath)
+	if err != nil {
+		failLocal(filePath, err, onError)
+		return
+	}
+
+	target := destinationKey(remote, filePath, time.Now())
+	var hash string
+	ok, lastErr := withRetries(ctx, remote, fileName, logger, func() error {
+		var err error
+		hash, err = sftpPut(ctx, remote, filePath, target, info.Size(), modTime)
+		return err
+	})
+
+	if ok {
+		if onSuccess != nil {
+			onSuccess(filePath, hash, modTime, Receipt{DocumentID: target, SHA256: hash, Size: info.Size()})
+		}
+		return
+	}
+	if onError != nil && lastErr != nil {
+		onError(filePath, lastErr)
+	}
+}
+
+// Check logs in and resolves the working directory.
+func (sftpUploader) Check(ctx context.Context, remote config.RemoteConfig) error {
+	conn, err := sftpDial(ctx, remote)
+	if err != nil {
+		return sftpError(err)
+	}
+	defer conn.Close()
+	s, err := sftp.NewClient(conn)
+	if err != nil {
+		return sftpError(err)
+	}
+	defer s.Close()
+	if _, err := s.Getwd(); err != nil {
+		return sftpError(err)
+	}
+	return nil
+}
+
+// sftpPut writes the file to a temporary name next to target and renames it
+// into place. It returns the SHA-256 of the bytes sent.
+func sftpPut(ctx context.Context, remote config.RemoteConfig, filePath string, target string, size int64, modTime int64) (string, error) {
+	b := breakerFor(remote.Endpoint)
+	s, err := sftpSessionFor(ctx, remote)
+	if err != nil {
+		if ctx.Err() == nil {
+			b.failure()
+		}
+		return "", sftpError(err)
+	}
+	defer s.Close()
+	// Anything but an SFTP status reply means the session or its connection
+	// is gone. A dead connection is replaced when the next session is opened.
+	fail := func(err error) error {
+		var status *sftp.StatusError
+		if errors.As(err, &status) || errors.Is(err, os.ErrPermission) || errors.Is(err, os.ErrNotExist) {
+			b.success()
+		} else if ctx.Err() == nil {
+			b.failure()
+		}
+		return sftpError(err)
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	dir := path.Dir(target)
+	if err := s.MkdirAll(dir); err != nil {
+		return "", fail(err)
+	}
+	tmp := path.Join(dir, "."+path.Base(target)+".part")
+	w, err := s.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return "", fail(err)
+	}
+
+	hasher := sha256.New()
+	idle := idleTimeout(remote)
+	reqCtx, body, stop := idleWatch(ctx, io.TeeReader(f, hasher), idle)
+	defer stop()
+
+	// A stalled or cancelled transfer is aborted by closing its own session
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-reqCtx.Done():
+			if ctx.Err() != nil || errors.Is(context.Cause(reqCtx), errIdleTransfer) {
+				s.Close()
+			}
+		case <-done:
+		}
+	}()
+
+	n, err := io.Copy(w, body)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.Remove(tmp)
+		return "", idleError(reqCtx, fail(err), idle)
+	}
+	if n != size {
+		s.Remove(tmp)
+		return "", &UploadError{Class: ClassTransient, Err: fmt.Errorf("file changed while uploading: expected %d bytes, sent %d", size, n)}
+	}
+	s.Chtimes(tmp, time.Now(), time.Unix(0, modTime))
+
+	// posix-rename replaces an existing file atomically. Plain SFTP rename
+	// refuses to, so without the extension an existing target is removed
+	// first, which is not atomic.
+	if _, ok := s.HasExtension("posix-rename@openssh.com"); ok {
+		err = s.PosixRename(tmp, target)
+	} else if err = s.Rename(tmp, target); err != nil {
+		if _, statErr := s.Stat(target); statErr == nil {
+			s.Remove(target)
+			err = s.Rename(tmp, target)
+		}
+	}
+	if err != nil {
+		s.Remove(tmp)
+		return "", fail(err)
+	}
+
+	info, err := s.Stat(target)
+	if err != nil {
+		return "", fail(err)
+	}
+	if info.Size() != size {
+		return "", &UploadError{Class: ClassTransient, Err: fmt.Errorf("size mismatch: sent %d bytes, server has %d", size, info.Size())}
+	}
+	b.success()
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// sftpError classifies an SFTP failure. Rejected credentials, unknown host
+// keys and write permissions are problems of the remote, not of the file.
+func sftpError(err error) error {
+	var uerr *UploadError
+	if errors.As(err, &uerr) {
+		return uerr
+	}
+	var keyErr *knownhosts.KeyError
+	var revoked *knownhosts.RevokedError
+	switch {
+	case errors.As(err, &keyErr) && len(keyErr.Want) == 0:
+		return &UploadError{Class: ClassAuth, Err: fmt.Errorf("host key is not in known_hosts: %w", err)}
+	case errors.As(err, &keyErr):
+		return &UploadError{Class: ClassAuth, Err: fmt.Errorf("host key does not match known_hosts: %w", err)}
+	case errors.As(err, &revoked):
+		return &UploadError{Class: ClassAuth, Err: err}
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		return &UploadError{Class: ClassAuth, Err: err}
+	case errors.Is(err, os.ErrPermission):
+		return &UploadError{Class: ClassAuth, Err: fmt.Errorf("permission denied: %w", err)}
+	}
+	return Classify(err)
+}
+
+// validateSFTP checks the settings an SFTP remote cannot connect without.
+func validateSFTP(remote config.RemoteConfig) error {
+	_, addr, err := sftpEndpoint(remote)
+	if err != nil {
+		return err
+	}
+	if _, err := sftpAuth(remote); err != nil {
+		return err
+	}
+	if _, _, err := sftpHostKeys(remote, addr); err != nil {
+		return err
+	}
+	return nil
+}
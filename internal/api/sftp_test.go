@@ -0,0 +1,154 @@
+package api
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpStandIn serves SFTP over SSH from a local directory and counts the SSH
+// connections it accepts.
+func sftpStandIn(t *testing.T, root string) (config.RemoteConfig, *atomic.Int32) {
+	t.Helper()
+	_, priv, _ := ed25519.GenerateKey(nil)
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ssh.ServerConfig{PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) { return nil, nil }}
+	cfg.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	conns := new(atomic.Int32)
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go serveSFTP(nc, cfg, root)
+		}
+	}()
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{ln.Addr().String()}, hostKey.PublicKey())
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return config.RemoteConfig{
+		Name: "sftp-" + ln.Addr().String(), Type: config.TypeSFTP, Endpoint: "sftp://agent@" + ln.Addr().String(),
+		Password: "secret", KnownHosts: knownHosts, Prefix: root, RetryAttempts: 1,
+	}, conns
+}
+
+func serveSFTP(nc net.Conn, cfg *ssh.ServerConfig, root string) {
+	_, chans, reqs, err := ssh.NewServerConn(nc, cfg)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nch := range chans {
+		ch, requests, err := nch.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					server, _ := sftp.NewServer(ch, sftp.WithServerWorkingDirectory(root))
+					server.Serve()
+					ch.Close()
+				}
+			}
+		}()
+	}
+}
+
+func TestSFTPTransfersShareTheConnection(t *testing.T) {
+	root := t.TempDir()
+	remote, conns := sftpStandIn(t, root)
+	src := t.TempDir()
+
+	// An aborted transfer closes only its own session
+	s, err := sftpSessionFor(context.Background(), remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			content := []byte(fmt.Sprintf("document %d", i))
+			path := filepath.Join(src, fmt.Sprintf("doc%d.txt", i))
+			os.WriteFile(path, content, 0o644)
+			target := filepath.Join(root, fmt.Sprintf("doc%d.txt", i))
+
+			hash, err := sftpPut(context.Background(), remote, path, target, int64(len(content)), time.Now().UnixNano())
+			sum := sha256.Sum256(content)
+			if err == nil && hash != hex.EncodeToString(sum[:]) {
+				err = fmt.Errorf("doc%d reported sha256 %s", i, hash)
+			}
+			if got, _ := os.ReadFile(target); err == nil && string(got) != string(content) {
+				err = fmt.Errorf("doc%d arrived as %q", i, got)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Fatalf("%d SSH connections, want 1 shared by all transfers", n)
+	}
+}
+
+func TestSFTPEndpointDefaultsPort(t *testing.T) {
+	for endpoint, want := range map[string]string{
+		"sftp://agent@files.example.com":      "files.example.com:22",
+		"sftp://agent@files.example.com:2222": "files.example.com:2222",
+		"sftp://agent@[2001:db8::1]/inbox":    "[2001:db8::1]:22",
+		"sftp://files.example.com":            "",
+		"https://agent@files.example.com":     "",
+	} {
+		user, addr, err := sftpEndpoint(config.RemoteConfig{Endpoint: endpoint})
+		if want == "" {
+			if err == nil {
+				t.Errorf("%s accepted as %s", endpoint, addr)
+			}
+			continue
+		}
+		if err != nil || user != "agent" || addr != want {
+			t.Errorf("%s parsed as %s@%s (%v), want agent@%s", endpoint, user, addr, err, want)
+		}
+	}
+}
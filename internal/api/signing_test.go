@@ -0,0 +1,63 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The vectors of docs/request-signing.md.
+func TestSignatureVectors(t *testing.T) {
+	body := `{"version":"0.2.0","queue_depth":3}`
+	sum := sha256.Sum256([]byte(body))
+	if got := hex.EncodeToString(sum[:]); got != "54d24053c7ffff05e5d9e53069957406f1f3f6cd787acf43a4d67d5669907609" {
+		t.Fatalf("body digest %s", got)
+	}
+
+	vectors := []struct {
+		method, path, timestamp, nonce, digest, want string
+	}{
+		{"POST", "/api/v1/agent/check", "1767225600", "0123456789abcdef0123456789abcdef",
+			hex.EncodeToString(sum[:]), "v1=391caa7f108c1074dc99d17fbf42fbb5aa1d4b5be5e4f4cbfc54a158ef05c49c"},
+		{"GET", "/api/v1/agent/exists?sha256=9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", "1767225660",
+			"fedcba9876543210fedcba9876543210", s3EmptyHash, "v1=807620923139df6891539417894a0356465474c474b21b9619e80f81fb3f4bf9"},
+	}
+	for _, v := range vectors {
+		if got := signature("k3y-for-docs-only", v.method, v.path, v.timestamp, v.nonce, v.digest); got != v.want {
+			t.Errorf("%s %s signed as %s, want %s", v.method, v.path, got, v.want)
+		}
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	body := `{"version":"0.2.0","queue_depth":3}`
+	req, _ := http.NewRequest("POST", "https://sift.example.com/api/v1/agent/check", bytes.NewReader([]byte(body)))
+	now := time.Unix(1767225600, 0)
+	if err := signRequest("k3y-for-docs-only", req, now); err != nil {
+		t.Fatal(err)
+	}
+
+	h := req.Header
+	if h.Get(HeaderTimestamp) != "1767225600" || len(h.Get(HeaderNonce)) != 32 {
+		t.Fatalf("timestamp %q, nonce %q", h.Get(HeaderTimestamp), h.Get(HeaderNonce))
+	}
+	if h.Get(HeaderBodySHA256) != "54d24053c7ffff05e5d9e53069957406f1f3f6cd787acf43a4d67d5669907609" {
+		t.Fatalf("body digest %s", h.Get(HeaderBodySHA256))
+	}
+	want := signature("k3y-for-docs-only", "POST", "/api/v1/agent/check", "1767225600", h.Get(HeaderNonce), h.Get(HeaderBodySHA256))
+	if h.Get(HeaderSignature) != want || !strings.HasPrefix(want, "v1=") {
+		t.Fatalf("signature %s, want %s", h.Get(HeaderSignature), want)
+	}
+
+	// Streamed bodies must come with their digest
+	streamed, _ := http.NewRequest("PUT", "https://sift.example.com/agent/upload", nil)
+	streamed.Body = io.NopCloser(strings.NewReader("x"))
+	if err := signRequest("k3y-for-docs-only", streamed, now); err != errUnsignableBody {
+		t.Fatalf("streamed body without digest signed: %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/go-resty/resty/v2"
+)
+
+// Connection timeouts, unless the remote sets its own. There is deliberately
+// no overall request timeout: large uploads may legitimately take hours, so a
+// stalled transfer is caught by the idle timeout instead.
+const (
+	defaultConnectTimeout  = 30 * time.Second
+	defaultTLSTimeout      = 15 * time.Second
+	defaultResponseTimeout = 2 * time.Minute
+	defaultIdleTimeout     = 1 * time.Minute
+)
+
+// NewClient returns a client that connects to the remote's endpoint with its
+// proxy, CA bundles, client certificate, SPKI pins and timeouts applied.
+func NewClient(remote config.RemoteConfig) (*resty.Client, error) {
+	transport, err := newTransport(remote)
+	if err != nil {
+		return nil, err
+	}
+	return resty.New().SetTransport(transport), nil
+}
+
+var (
+	clientsMu       sync.Mutex
+	transports      = make(map[string]*http.Transport)
+	tokenTransports = make(map[string]*http.Transport)
+	clients         = make(map[string]*resty.Client)
+)
+
+// transportFor returns the remote's shared connection pool.
+func transportFor(remote config.RemoteConfig) (*http.Transport, error) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	return transportLocked(remote)
+}
+
+// tokenTransportFor returns the connection pool for the remote's token_url.
+// The token server is another host, so it gets the remote's proxy and CA
+// bundles but not the endpoint's SPKI pins or client certificate.
+func tokenTransportFor(remote config.RemoteConfig) (*http.Transport, error) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if t, ok := tokenTransports[remote.Name]; ok {
+		return t, nil
+	}
+	remote.SPKIPins = nil
+	remote.ClientCert, remote.ClientKey = "", ""
+	t, err := newTransport(remote)
+	if err != nil {
+		return nil, err
+	}
+	tokenTransports[remote.Name] = t
+	return t, nil
+}
+
+func transportLocked(remote config.RemoteConfig) (*http.Transport, error) {
+	if t, ok := transports[remote.Name]; ok {
+		return t, nil
+	}
+	t, err := newTransport(remote)
+	if err != nil {
+		return nil, err
+	}
+	transports[remote.Name] = t
+	return t, nil
+}
+
+// clientFor returns the client shared by all uploads of a remote. It feeds
+// the endpoint's circuit breaker, streams bodies with their length and signs
+// requests to S3 destinations.
+func clientFor(remote config.RemoteConfig) (*resty.Client, error) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if c, ok := clients[remote.Name]; ok {
+		return c, nil
+	}
+	t, err := transportLocked(remote)
+	if err != nil {
+		return nil, err
+	}
+	c := resty.New().SetTransport(t)
+	if remote.DestinationType() == config.TypeS3 {
+		c.SetPreRequestHook(s3Signer(remote))
+	} else {
+		withAuth(c.SetPreRequestHook(signed(remote, streamBody)), remote)
+	}
+	trackEndpoint(c, remote.Endpoint)
+	clients[remote.Name] = c
+	return c, nil
+}
+
+func newTransport(remote config.RemoteConfig) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{
+		Timeout:   durationOr(remote.ConnectTimeout, defaultConnectTimeout),
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	t.TLSHandshakeTimeout = durationOr(remote.TLSTimeout, defaultTLSTimeout)
+	t.ResponseHeaderTimeout = durationOr(remote.ResponseTimeout, defaultResponseTimeout)
+	t.MaxIdleConnsPerHost = 16 // One per upload worker
+
+	switch remote.Proxy {
+	case "":
+		// Environment proxies (HTTPS_PROXY, NO_PROXY) as before
+	case "none":
+		t.Proxy = nil
+	default:
+		// Credentials in the URL are sent as Proxy-Authorization, including on CONNECT
+		proxyURL, err := url.Parse(remote.Proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q", redactProxy(remote.Proxy))
+		}
+		t.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if len(remote.CAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, file := range remote.CAFiles {
+			pem, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in CA bundle %s", file)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if remote.ClientCert != "" || remote.ClientKey != "" {
+		if remote.ClientCert == "" || remote.ClientKey == "" {
+			return nil, errors.New("client_cert and client_key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(remote.ClientCert, remote.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(remote.SPKIPins) > 0 {
+		pins := make([]string, 0, len(remote.SPKIPins))
+		for _, pin := range remote.SPKIPins {
+			pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+			if raw, err := base64.StdEncoding.DecodeString(pin); err != nil || len(raw) != sha256.Size {
+				return nil, fmt.Errorf("invalid SPKI pin %q: expected base64 SHA-256", pin)
+			}
+			pins = append(pins, pin)
+		}
+		// Runs after normal chain verification, so a pin narrows trust and
+		// never replaces it
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if slices.Contains(pins, base64.StdEncoding.EncodeToString(sum[:])) {
+					return nil
+				}
+			}
+			return errors.New("server certificate does not match any configured SPKI pin")
+		}
+	}
+
+	t.TLSClientConfig = tlsConfig
+	return t, nil
+}
+
+func durationOr(s string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+func idleTimeout(remote config.RemoteConfig) time.Duration {
+	return durationOr(remote.IdleTimeout, defaultIdleTimeout)
+}
+
+var errIdleTransfer = errors.New("transfer stalled")
+
+// idleBody cancels its request when the transport stops consuming the body
+// for longer than idle, as happens on a half-open connection once the socket
+// buffers fill. Once the body is fully read the response header timeout takes
+// over.
+type idleBody struct {
+	r     io.Reader
+	timer *time.Timer
+	idle  time.Duration
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil {
+		b.timer.Stop()
+	} else {
+		b.timer.Reset(b.idle)
+	}
+	return n, err
+}
+
+// idleWatch wraps body so that the returned context is cancelled with
+// errIdleTransfer when the body stops being read. stop must be called when
+// the transfer is done.
+func idleWatch(ctx context.Context, body io.Reader, idle time.Duration) (context.Context, io.Reader, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	timer := time.AfterFunc(idle, func() { cancel(errIdleTransfer) })
+	stop := func() {
+		timer.Stop()
+		cancel(nil)
+	}
+	return ctx, &idleBody{r: body, timer: timer, idle: idle}, stop
+}
+
+// watchIdle streams body with the request made with the returned context,
+// which is cancelled with errIdleTransfer when the body stops moving. stop
+// must be called when the request is done.
+func watchIdle(ctx context.Context, body io.Reader, idle time.Duration) (context.Context, func()) {
+	ctx, body, stop := idleWatch(ctx, body, idle)
+	return withStreamBody(ctx, body), stop
+}
+
+// idleError replaces the bare "context canceled" of a request aborted by
+// watchIdle with the reason.
+func idleError(ctx context.Context, err error, idle time.Duration) error {
+	if errors.Is(context.Cause(ctx), errIdleTransfer) {
+		return fmt.Errorf("%w: no bytes sent for %s", errIdleTransfer, idle)
+	}
+	return err
+}
+
+// timeoutKind names the timeout behind err, or returns "" if err is not one.
+func timeoutKind(err error) string {
+	if errors.Is(err, errIdleTransfer) {
+		return "idle transfer"
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "timeout awaiting response headers"):
+		return "response header"
+	case strings.Contains(msg, "TLS handshake timeout"):
+		return "TLS handshake"
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout() {
+		return "connect"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "network"
+	}
+	return ""
+}
+
+// describeError prefixes timeouts with their kind for logs.
+func describeError(err error) string {
+	if kind := timeoutKind(err); kind != "" {
+		return fmt.Sprintf("%s timeout: %v", kind, err)
+	}
+	return err.Error()
+}
+
+// redactProxy hides proxy credentials for logs and errors.
+func redactProxy(proxy string) string {
+	if u, err := url.Parse(proxy); err == nil {
+		return u.Redacted()
+	}
+	return "<invalid>"
+}
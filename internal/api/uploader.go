@@ -0,0 +1,191 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+)
+
+// Uploader delivers settled files to a remote's destination. Upload reports
+// through the same callbacks as UploadFile: onSuccess with the SHA-256 of the
+// bytes sent, onError with an *UploadError once retries are exhausted.
+type Uploader interface {
+	Upload(ctx context.Context, remote config.RemoteConfig, filePath string, modTime int64,
+		onSuccess func(string, string, int64, Receipt), onError func(string, error), logger func(string, ...interface{}))
+
+	// Check verifies that the destination is reachable and accepts the
+	// remote's credentials.
+	Check(ctx context.Context, remote config.RemoteConfig) error
+}
+
+// UploaderFor returns the uploader for the remote's destination type, or an
+// error if the remote's destination settings are incomplete.
+func UploaderFor(remote config.RemoteConfig) (Uploader, error) {
+	if err := validateChunkSize(remote); err != nil {
+		return nil, err
+	}
+	var u Uploader
+	switch remote.DestinationType() {
+	case config.TypeSift:
+		if err := validateAuth(remote); err != nil {
+			return nil, err
+		}
+		if err := validateEncryption(remote); err != nil {
+			return nil, err
+		}
+		return siftUploader{}, nil
+	case config.TypeS3:
+		if remote.Bucket == "" {
+			return nil, fmt.Errorf("s3 remote %s has no bucket", remote.Name)
+		}
+		if accessKey, secretKey, _ := s3Credentials(remote); accessKey == "" || secretKey == "" {
+			return nil, fmt.Errorf("s3 remote %s has no credentials: set access_key and secret_key or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY", remote.Name)
+		}
+		u = s3Uploader{}
+	case config.TypeSFTP:
+		if err := validateSFTP(remote); err != nil {
+			return nil, err
+		}
+		u = sftpUploader{}
+	case config.TypeDir:
+		if err := validateDir(remote); err != nil {
+			return nil, err
+		}
+		u = dirUploader{}
+	default:
+		return nil, fmt.Errorf("unknown remote type %q", remote.Type)
+	}
+
+	if strings.EqualFold(remote.DedupPolicy, config.DedupReference) {
+		return nil, fmt.Errorf("dedup_policy %s needs a Sift server, use skip or always", config.DedupReference)
+	}
+	if signs(remote) {
+		return nil, fmt.Errorf("signing_key needs a Sift server")
+	}
+	if Encrypts(remote) {
+		return nil, fmt.Errorf("encrypt_to needs a Sift server")
+	}
+	return u, nil
+}
+
+// failLocal reports an upload that ended before reaching the destination, on
+// an unreadable file or unusable remote settings, so the caller still records
+// the failure and schedules a retry.
+func failLocal(filePath string, err error, onError func(string, error)) {
+	if onError != nil {
+		onError(filePath, Classify(err))
+	}
+}
+
+// siftUploader posts files to <endpoint>/agent/upload.
+type siftUploader struct{}
+
+func (siftUploader) Upload(ctx context.Context, remote config.RemoteConfig, filePath string, modTime int64,
+	onSuccess func(string, string, int64, Receipt), onError func(string, error), logger func(string, ...interface{})) {
+	UploadFile(ctx, remote, filePath, modTime, onSuccess, onError, logger)
+}
+
+func (siftUploader) Check(ctx context.Context, remote config.RemoteConfig) error {
+	client, err := NewClient(remote)
+	if err != nil {
+		return err
+	}
+	resp, err := withAuth(client.SetPreRequestHook(signed(remote, nil)), remote).R().
+		SetContext(ctx).
+		Get(remote.Endpoint + "/agent/check")
+	if err != nil {
+		return Classify(err)
+	}
+	if resp.StatusCode() != 200 {
+		return statusError(resp, "check failed")
+	}
+	return nil
+}
+
+// withRetries runs attempt under the remote's retry policy. It reports
+// whether an attempt succeeded and otherwise returns the last failure, which
+// is nil when ctx ended first.
+func withRetries(ctx context.Context, remote config.RemoteConfig, fileName string, logger func(string, ...interface{}), attempt func() error) (bool, *UploadError) {
+	policy := retryPolicyFor(remote)
+	var lastErr *UploadError
+	renewed := false
+	defer logKeyNotices(remote, logger)
+	for n := 0; n < policy.attempts; n++ {
+		err := attempt()
+		if err == nil {
+			return true, nil
+		}
+		if ctx.Err() != nil {
+			return false, nil
+		}
+
+		lastErr = Classify(err)
+		if tokenRenewable(remote, lastErr) && !renewed {
+			// The rejected token was dropped or the other key is up. It gets a free attempt.
+			renewed = true
+			n--
+			continue
+		}
+		wait, retry := policy.next(lastErr, n)
+		if !retry || n == policy.attempts-1 {
+			if logger != nil {
+				logger("[%s] Upload of %s failed (attempt %d/%d): %v", remote.Name, fileName, n+1, policy.attempts, lastErr)
+			}
+			break
+		}
+		if logger != nil {
+			logger("[%s] Upload of %s failed (attempt %d/%d): %v. Retrying in %s", remote.Name, fileName, n+1, policy.attempts, lastErr, wait.Round(time.Millisecond))
+		}
+		if !sleepCtx(ctx, wait) {
+			return false, nil
+		}
+	}
+	return false, lastErr
+}
+
+// expandTemplate fills a destination path template for a file. Placeholders:
+//
+//	{name}    file name              {stem} file name without extension
+//	{ext}     extension without dot  {remote} remote name
+//	{host}    agent hostname         {date} upload date as yyyy-mm-dd
+//	{yyyy} {mm} {dd} {hh}            upload date and hour in UTC
+//
+// Unknown placeholders are left as they are.
+func expandTemplate(tmpl string, remote config.RemoteConfig, fileName string, now time.Time) string {
+	if tmpl == "" {
+		return ""
+	}
+	now = now.UTC()
+	ext := path.Ext(fileName)
+	host, _ := os.Hostname()
+	return strings.NewReplacer(
+		"{name}", fileName,
+		"{stem}", strings.TrimSuffix(fileName, ext),
+		"{ext}", strings.TrimPrefix(ext, "."),
+		"{remote}", remote.Name,
+		"{host}", host,
+		"{date}", now.Format("2006-01-02"),
+		"{yyyy}", now.Format("2006"),
+		"{mm}", now.Format("01"),
+		"{dd}", now.Format("02"),
+		"{hh}", now.Format("15"),
+	).Replace(tmpl)
+}
+
+// destinationKey returns the slash-separated path of a file under the
+// remote's prefix template, named by its name template. It is absolute if the
+// prefix is.
+func destinationKey(remote config.RemoteConfig, filePath string, now time.Time) string {
+	fileName := filepath.Base(filePath)
+	name := path.Base(expandTemplate(remote.NameTemplate, remote, fileName, now))
+	if name == "." || name == "/" {
+		name = fileName
+	}
+	return path.Join(expandTemplate(remote.Prefix, remote, fileName, now), name)
+}
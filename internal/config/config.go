@@ -1,15 +1,208 @@
 package config
 
+import (
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Dedup policies applied when a file's content hash matches a file that was
+// already uploaded to the same endpoint.
+const (
+	DedupAlways    = "always"    // Upload regardless of previous uploads
+	DedupSkip      = "skip"      // Archive without contacting the server
+	DedupReference = "reference" // Register a reference to the original upload
+)
+
+// Request compression modes. Compression is only applied when the server
+// advertises the encoding, and never together with content_md5.
+const (
+	CompressionOff  = "off"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionAuto = "auto" // Best supported encoding, skipping already-compressed formats
+)
+
+// MaxChunkSize bounds chunk_size, since every upload in flight holds a chunk
+// in memory.
+const MaxChunkSize = 256 << 20
+
+// Authentication modes of a Sift remote.
+const (
+	AuthKey    = "key"    // Static key sent as bearer token
+	AuthOAuth2 = "oauth2" // Short-lived tokens from an OAuth2 client-credentials grant
+)
+
+// Destination types. A remote delivers to a Sift server unless it sets one of
+// the others.
+const (
+	TypeSift = "sift"
+	TypeS3   = "s3"   // S3-compatible object storage (AWS, MinIO, ...)
+	TypeSFTP = "sftp" // SFTP server, endpoint sftp://user@host[:port]
+	TypeDir  = "dir"  // Local or UNC directory, endpoint e.g. E:\Outbox or \\server\share\in
+)
+
 type RemoteConfig struct {
-	Name               string `mapstructure:"name"`
-	Path               string `mapstructure:"path"`
-	Endpoint           string `mapstructure:"endpoint"`
-	Key                string `mapstructure:"key"`
-	StabilityThreshold int    `mapstructure:"stability_threshold"` // Checks in worker
-	CheckInterval      string `mapstructure:"check_interval"`      // Time between worker checks
-	StabilityTimeout   string `mapstructure:"stability_timeout"`   // Max wait time
-	ConcurrencyLimit   int    `mapstructure:"concurrency_limit"`   // Max parallel uploads
-	PollingInterval    string `mapstructure:"polling_interval"`    // Backup scan frequency
-	SettlingDelay      string `mapstructure:"settling_delay"`      // Initial "quiet" period
-	DisableFsnotify    bool   `mapstructure:"disable_fsnotify"`    // Disable real-time watcher
+	Name               string   `mapstructure:"name"`
+	Path               string   `mapstructure:"path"`
+	Type               string   `mapstructure:"type"` // sift | s3 | sftp | dir (default sift)
+	Endpoint           string   `mapstructure:"endpoint"`
+	Key                string   `mapstructure:"key"`
+	SecondaryKey       string   `mapstructure:"secondary_key"`       // Fallback key while a key is rotated
+	KeyEnv             string   `mapstructure:"key_env"`             // Environment variable holding the key
+	KeyFile            string   `mapstructure:"key_file"`            // File holding the key
+	Auth               string   `mapstructure:"auth"`                // key | oauth2 (default key)
+	TokenURL           string   `mapstructure:"token_url"`           // OAuth2 token endpoint
+	ClientID           string   `mapstructure:"client_id"`           // OAuth2 client ID
+	ClientSecret       string   `mapstructure:"client_secret"`       // OAuth2 client secret
+	Scopes             []string `mapstructure:"scopes"`              // OAuth2 scopes to request
+	SigningKey         string   `mapstructure:"signing_key"`         // Sign requests with HMAC-SHA256 using this key
+	EncryptTo          string   `mapstructure:"encrypt_to"`          // Recipient public key (PEM), encrypts files before upload
+	StabilityThreshold int      `mapstructure:"stability_threshold"` // Checks in worker
+	CheckInterval      string   `mapstructure:"check_interval"`      // Time between worker checks
+	StabilityTimeout   string   `mapstructure:"stability_timeout"`   // Max wait time
+	ConcurrencyLimit   int      `mapstructure:"concurrency_limit"`   // Max parallel uploads
+	PollingInterval    string   `mapstructure:"polling_interval"`    // Backup scan frequency
+	SettlingDelay      string   `mapstructure:"settling_delay"`      // Initial "quiet" period
+	DisableFsnotify    bool     `mapstructure:"disable_fsnotify"`    // Disable real-time watcher
+	DedupPolicy        string   `mapstructure:"dedup_policy"`        // always | skip | reference
+	ContentMD5         bool     `mapstructure:"content_md5"`         // Send Content-MD5 of the upload body
+	ChunkThreshold     string   `mapstructure:"chunk_threshold"`     // Resumable uploads at or above this size ("0" disables)
+	ChunkSize          string   `mapstructure:"chunk_size"`          // Chunk size for resumable uploads
+	Compression        string   `mapstructure:"compression"`         // off | gzip | zstd | auto
+	RetryAttempts      int      `mapstructure:"retry_attempts"`      // Upload attempts per cycle
+	RetryBaseDelay     string   `mapstructure:"retry_base_delay"`    // First backoff delay, doubled per attempt
+	RetryMaxDelay      string   `mapstructure:"retry_max_delay"`     // Backoff ceiling, longer Retry-After pauses the remote
+	HeartbeatInterval  string   `mapstructure:"heartbeat_interval"`  // Time between status reports to the server
+	Pinned             []string `mapstructure:"pinned"`              // Fields the server may not override
+	Proxy              string   `mapstructure:"proxy"`               // http(s)://[user:pass@]host:port, "none" ignores environment proxies
+	CAFiles            []string `mapstructure:"ca_files"`            // Extra PEM CA bundles trusted alongside the system roots
+	ClientCert         string   `mapstructure:"client_cert"`         // PEM client certificate for mutual TLS
+	ClientKey          string   `mapstructure:"client_key"`          // PEM private key for client_cert
+	SPKIPins           []string `mapstructure:"spki_pins"`           // Base64 SHA-256 of accepted server public keys
+	ConnectTimeout     string   `mapstructure:"connect_timeout"`     // TCP connect (default 30s)
+	TLSTimeout         string   `mapstructure:"tls_timeout"`         // TLS handshake (default 15s)
+	ResponseTimeout    string   `mapstructure:"response_timeout"`    // Wait for response headers after the body is sent (default 2m)
+	IdleTimeout        string   `mapstructure:"idle_timeout"`        // Abort an upload whose body stops moving for this long (default 1m)
+
+	// S3, SFTP and directory destinations
+	Prefix       string `mapstructure:"prefix"`        // Key prefix or directory template, e.g. "{remote}/{yyyy}/{mm}/{dd}"
+	NameTemplate string `mapstructure:"name_template"` // Destination file name, e.g. "{stem}_{host}.{ext}" (default {name})
+
+	// S3 destinations. Large files use multipart uploads, with chunk_threshold
+	// and chunk_size as the multipart threshold and part size.
+	Bucket    string `mapstructure:"bucket"`
+	Region    string `mapstructure:"region"`     // Signing region (default us-east-1)
+	AccessKey string `mapstructure:"access_key"` // Falls back to AWS_ACCESS_KEY_ID
+	SecretKey string `mapstructure:"secret_key"` // Falls back to AWS_SECRET_ACCESS_KEY
+
+	// SFTP destinations. The user name is taken from the endpoint URL.
+	Password   string `mapstructure:"password"`    // Password, or the passphrase of an encrypted private_key
+	PrivateKey string `mapstructure:"private_key"` // Path to an OpenSSH/PEM private key
+	KnownHosts string `mapstructure:"known_hosts"` // Host keys to trust (default ~/.ssh/known_hosts)
+
+	// Additional destinations every file is also delivered to, each with the
+	// destination settings of a remote (type, endpoint, key, bucket, ...).
+	// Files are archived once the remote's own endpoint and every required
+	// destination have them.
+	Destinations []RemoteConfig `mapstructure:"destinations"`
+	Optional     bool           `mapstructure:"optional"` // Destinations only: do not hold the file back, retry from .done
+}
+
+// DestinationType returns the remote's normalized destination type.
+func (r RemoteConfig) DestinationType() string {
+	if r.Type == "" {
+		return TypeSift
+	}
+	return strings.ToLower(r.Type)
+}
+
+// OAuth2 reports whether the remote authenticates with OAuth2 access tokens.
+func (r RemoteConfig) OAuth2() bool {
+	return strings.EqualFold(r.Auth, AuthOAuth2)
+}
+
+// Targets returns the remote's additional destinations, named
+// "<remote>/<destination>" so each keeps its own connections and delivery
+// status. Unnamed destinations are numbered from 1.
+func (r RemoteConfig) Targets() []RemoteConfig {
+	targets := make([]RemoteConfig, 0, len(r.Destinations))
+	for i, d := range r.Destinations {
+		name := d.Name
+		if name == "" {
+			name = strconv.Itoa(i + 1)
+		}
+		d.Name = r.Name + "/" + name
+		d.Path = r.Path
+		d.Destinations = nil
+		targets = append(targets, d)
+	}
+	return targets
+}
+
+// Settings returns the remote's non-empty settings under their config file
+// names, for writing the remote back to the config file.
+func (r RemoteConfig) Settings() map[string]interface{} {
+	settings := make(map[string]interface{})
+	v := reflect.ValueOf(r)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).IsZero() || (v.Field(i).Kind() == reflect.Slice && v.Field(i).Len() == 0) {
+			continue
+		}
+		name := v.Type().Field(i).Tag.Get("mapstructure")
+		if destinations, ok := v.Field(i).Interface().([]RemoteConfig); ok {
+			list := make([]map[string]interface{}, len(destinations))
+			for j, d := range destinations {
+				list[j] = d.Settings()
+			}
+			settings[name] = list
+			continue
+		}
+		settings[name] = v.Field(i).Interface()
+	}
+	return settings
+}
+
+// Transport holds the connection settings that may also be given at the top
+// level of the config file, as defaults for every remote.
+type Transport struct {
+	Proxy      string   `mapstructure:"proxy"`
+	CAFiles    []string `mapstructure:"ca_files"`
+	ClientCert string   `mapstructure:"client_cert"`
+	ClientKey  string   `mapstructure:"client_key"`
+	SPKIPins   []string `mapstructure:"spki_pins"`
+
+	ConnectTimeout  string `mapstructure:"connect_timeout"`
+	TLSTimeout      string `mapstructure:"tls_timeout"`
+	ResponseTimeout string `mapstructure:"response_timeout"`
+	IdleTimeout     string `mapstructure:"idle_timeout"`
+}
+
+// InheritTransport fills the connection settings the remote leaves unset from
+// the global defaults. The client certificate and key are inherited together.
+func (r *RemoteConfig) InheritTransport(global Transport) {
+	if r.Proxy == "" {
+		r.Proxy = global.Proxy
+	}
+	if len(r.CAFiles) == 0 {
+		r.CAFiles = global.CAFiles
+	}
+	if r.ClientCert == "" && r.ClientKey == "" {
+		r.ClientCert, r.ClientKey = global.ClientCert, global.ClientKey
+	}
+	if len(r.SPKIPins) == 0 {
+		r.SPKIPins = global.SPKIPins
+	}
+	if r.ConnectTimeout == "" {
+		r.ConnectTimeout = global.ConnectTimeout
+	}
+	if r.TLSTimeout == "" {
+		r.TLSTimeout = global.TLSTimeout
+	}
+	if r.ResponseTimeout == "" {
+		r.ResponseTimeout = global.ResponseTimeout
+	}
+	if r.IdleTimeout == "" {
+		r.IdleTimeout = global.IdleTimeout
+	}
 }
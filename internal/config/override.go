@@ -0,0 +1,103 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Overridable lists the remote settings the server may push. Identity and
+// credentials (name, path, endpoint, key) and the watch mode, which needs a
+// restart, are never taken from the server.
+var Overridable = []string{
+	"stability_threshold", "check_interval", "stability_timeout", "concurrency_limit",
+	"polling_interval", "settling_delay", "dedup_policy", "compression",
+	"chunk_threshold", "chunk_size", "retry_attempts", "retry_base_delay",
+	"retry_max_delay", "heartbeat_interval",
+}
+
+// IsPinned reports whether the field is pinned to its local value.
+func (r RemoteConfig) IsPinned(field string) bool {
+	return slices.Contains(r.Pinned, field) || slices.Contains(r.Pinned, "*")
+}
+
+// ApplyOverride validates value for field and sets it on r.
+func ApplyOverride(r *RemoteConfig, field string, value string) error {
+	if !slices.Contains(Overridable, field) {
+		return fmt.Errorf("%s cannot be overridden", field)
+	}
+
+	switch field {
+	case "stability_threshold", "concurrency_limit", "retry_attempts":
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("%s must be a positive integer, got %q", field, value)
+		}
+		switch field {
+		case "stability_threshold":
+			r.StabilityThreshold = n
+		case "concurrency_limit":
+			r.ConcurrencyLimit = n
+		case "retry_attempts":
+			r.RetryAttempts = n
+		}
+
+	case "check_interval", "stability_timeout", "polling_interval", "settling_delay",
+		"retry_base_delay", "retry_max_delay", "heartbeat_interval":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("%s must be a duration, got %q", field, value)
+		}
+		switch field {
+		case "check_interval":
+			r.CheckInterval = value
+		case "stability_timeout":
+			r.StabilityTimeout = value
+		case "polling_interval":
+			r.PollingInterval = value
+		case "settling_delay":
+			r.SettlingDelay = value
+		case "retry_base_delay":
+			r.RetryBaseDelay = value
+		case "retry_max_delay":
+			r.RetryMaxDelay = value
+		case "heartbeat_interval":
+			r.HeartbeatInterval = value
+		}
+
+	case "chunk_threshold", "chunk_size":
+		n, err := humanize.ParseBytes(value)
+		if err != nil {
+			return fmt.Errorf("%s must be a size such as 64MB, got %q", field, value)
+		}
+		if field == "chunk_size" && n > MaxChunkSize {
+			return fmt.Errorf("chunk_size must be at most %s, got %q", humanize.IBytes(MaxChunkSize), value)
+		}
+		if field == "chunk_threshold" {
+			r.ChunkThreshold = value
+		} else {
+			r.ChunkSize = value
+		}
+
+	case "dedup_policy":
+		switch strings.ToLower(value) {
+		case DedupAlways, DedupSkip, DedupReference:
+			r.DedupPolicy = value
+		default:
+			return fmt.Errorf("dedup_policy must be one of always, skip, reference, got %q", value)
+		}
+
+	case "compression":
+		switch strings.ToLower(value) {
+		case CompressionOff, CompressionGzip, CompressionZstd, CompressionAuto:
+			r.Compression = value
+		default:
+			return fmt.Errorf("compression must be one of off, gzip, zstd, auto, got %q", value)
+		}
+	}
+	return nil
+}
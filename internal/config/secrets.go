@@ -0,0 +1,201 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Secrets need not be written to the config file in clear text. The key of a
+// remote can be read from an environment variable (key_env) or a file
+// (key_file), and every secret setting can hold a value sealed with the
+// machine key, a key file that stays on this machine, written as
+// "sealed:<base64>". Sealed values are AES-256-GCM encrypted and cannot be
+// opened without the machine key file.
+const sealedPrefix = "sealed:"
+
+// IsSealed reports whether a secret setting holds a sealed value.
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
+
+// secrets returns the remote's secret settings.
+func (r *RemoteConfig) secrets() map[string]*string {
+	return map[string]*string{
+		"key":           &r.Key,
+		"secondary_key": &r.SecondaryKey,
+		"client_secret": &r.ClientSecret,
+		"secret_key":    &r.SecretKey,
+		"password":      &r.Password,
+		"signing_key":   &r.SigningKey,
+	}
+}
+
+// ResolveSecrets reads key_env and key_file and opens sealed values, for the
+// remote and its destinations. machineKey is the path of the machine key file.
+func (r *RemoteConfig) ResolveSecrets(machineKey string) error {
+	switch {
+	case r.KeyEnv != "" && r.KeyFile != "":
+		return errors.New("set either key_env or key_file, not both")
+	case r.KeyEnv != "":
+		r.Key = strings.TrimSpace(os.Getenv(r.KeyEnv))
+		if r.Key == "" {
+			return fmt.Errorf("key_env %s is not set", r.KeyEnv)
+		}
+	case r.KeyFile != "":
+		data, err := os.ReadFile(r.KeyFile)
+		if err != nil {
+			return fmt.Errorf("key_file: %w", err)
+		}
+		r.Key = strings.TrimSpace(string(data))
+		if r.Key == "" {
+			return fmt.Errorf("key_file %s is empty", r.KeyFile)
+		}
+	}
+
+	var gcm cipher.AEAD
+	for name, value := range r.secrets() {
+		if !IsSealed(*value) {
+			continue
+		}
+		if gcm == nil {
+			var err error
+			if gcm, err = machineCipher(machineKey, false); err != nil {
+				return err
+			}
+		}
+		plain, err := open(gcm, *value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		*value = plain
+	}
+
+	for i := range r.Destinations {
+		if err := r.Destinations[i].ResolveSecrets(machineKey); err != nil {
+			return fmt.Errorf("destination %s: %w", r.Destinations[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// SealSecrets seals the secret settings still in clear text, for the remote
+// and its destinations. The machine key file is created if needed.
+func (r *RemoteConfig) SealSecrets(machineKey string) error {
+	for _, value := range r.secrets() {
+		if *value == "" || IsSealed(*value) {
+			continue
+		}
+		sealed, err := Seal(*value, machineKey)
+		if err != nil {
+			return err
+		}
+		*value = sealed
+	}
+	for i := range r.Destinations {
+		if err := r.Destinations[i].SealSecrets(machineKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HasPlaintextSecrets reports whether any secret setting of the remote or its
+// destinations is stored in clear text.
+func (r RemoteConfig) HasPlaintextSecrets() bool {
+	for _, value := range r.secrets() {
+		if *value != "" && !IsSealed(*value) {
+			return true
+		}
+	}
+	for _, d := range r.Destinations {
+		if d.HasPlaintextSecrets() {
+			return true
+		}
+	}
+	return false
+}
+
+// Seal encrypts a secret with the machine key file, creating the key file
+// if needed.
+func Seal(plain string, machineKey string) (string, error) {
+	gcm, err := machineCipher(machineKey, true)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return sealedPrefix + base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(plain), nil)), nil
+}
+
+func open(gcm cipher.AEAD, sealed string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, sealedPrefix))
+	if err != nil || len(data) < gcm.NonceSize() {
+		return "", errors.New("malformed sealed value")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("cannot open sealed value: it was sealed with a different machine key file")
+	}
+	return string(plain), nil
+}
+
+// machineCipher loads the machine key file. With create, a missing file is
+// generated and restricted to the service account and administrators. An
+// existing file that other accounts can read is refused.
+func machineCipher(machineKey string, create bool) (cipher.AEAD, error) {
+	data, err := os.ReadFile(machineKey)
+	if errors.Is(err, os.ErrNotExist) && create {
+		data, err = createMachineKey(machineKey)
+	} else if err == nil {
+		err = checkKeyAccess(machineKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("machine key file: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("machine key file %s is not a base64 256-bit key", machineKey)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func createMachineKey(machineKey string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	data := []byte(base64.StdEncoding.EncodeToString(key) + "\n")
+
+	if err := os.MkdirAll(filepath.Dir(machineKey), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(machineKey, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = restrictToService(machineKey)
+	}
+	if err != nil {
+		os.Remove(machineKey)
+		return nil, err
+	}
+	return data, nil
+}
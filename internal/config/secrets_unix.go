@@ -0,0 +1,31 @@
+//go:build !windows
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// restrictToService is a no-op, the file is created readable by its owner
+// only, the account the agent runs as.
+func restrictToService(path string) error {
+	return nil
+}
+
+// checkKeyAccess refuses a key file that other accounts can read or that
+// belongs to someone other than the agent's account or root.
+func checkKeyAccess(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		return fmt.Errorf("%s is accessible by group or others (mode %04o), run chmod 600 on it", path, perm)
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() && st.Uid != 0 {
+		return fmt.Errorf("%s is owned by uid %d, not by the agent's account", path, st.Uid)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadableMachineKeyIsRefused(t *testing.T) {
+	machineKey := filepath.Join(t.TempDir(), "machine.key")
+	sealed, err := Seal("s3cret", machineKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(machineKey); info.Mode().Perm() != 0o600 {
+		t.Fatalf("key file created with mode %04o", info.Mode().Perm())
+	}
+
+	os.Chmod(machineKey, 0o644)
+	r := RemoteConfig{Name: "office", Key: sealed}
+	if err := r.ResolveSecrets(machineKey); err == nil {
+		t.Fatal("world-readable key file used")
+	}
+
+	os.Chmod(machineKey, 0o600)
+	r = RemoteConfig{Name: "office", Key: sealed}
+	if err := r.ResolveSecrets(machineKey); err != nil || r.Key != "s3cret" {
+		t.Fatalf("key resolved as %q: %v", r.Key, err)
+	}
+}
@@ -0,0 +1,187 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/api"
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/cleverdata/sift-agent/internal/db"
+)
+
+// archive is called once the remote's own endpoint has the file. It delivers
+// the file to the remote's additional destinations and moves it to .done when
+// every required one has it. A required destination that fails holds the file
+// back until its retry, and one that rejects the file or keeps failing, now or
+// on an earlier attempt, sends it to .quarantine. Optional destinations are retried later from .done.
+func archive(ctx context.Context, remote config.RemoteConfig, absPath string, modTime int64, logger Logger) {
+	targets := remote.Targets()
+	if len(targets) == 0 {
+		moveToDone(absPath, remote, logger)
+		return
+	}
+
+	var holdUntil time.Time
+	for _, dest := range targets {
+		switch db.DestinationStatus(absPath, dest.Name, modTime) {
+		case db.StatusUploaded:
+			continue
+		case db.StatusFailed:
+			if !dest.Optional {
+				if logger != nil {
+					logger.Warningf("[%s] %s was refused by %s.", remote.Name, filepath.Base(absPath), dest.Name)
+				}
+				quarantine(absPath, remote, logger)
+				return
+			}
+			continue
+		}
+
+		ok, next := deliver(ctx, remote, dest, absPath, modTime, logger)
+		if ok || dest.Optional {
+			continue
+		}
+		if next.IsZero() {
+			if ctx.Err() == nil {
+				quarantine(absPath, remote, logger)
+			}
+			return
+		}
+		if holdUntil.IsZero() || next.Before(holdUntil) {
+			holdUntil = next
+		}
+	}
+
+	if ctx.Err() != nil {
+		return
+	}
+	if !holdUntil.IsZero() {
+		db.ScheduleRetry(absPath, remote.Name, modTime, holdUntil)
+		if logger != nil {
+			logger.Warningf("[%s] Holding %s until all required destinations have it.", remote.Name, filepath.Base(absPath))
+		}
+		return
+	}
+	if done, ok := moveToDone(absPath, remote, logger); ok {
+		db.MoveDestinations(absPath, done)
+	}
+}
+
+// deliver uploads the file to one additional destination. On failure it
+// returns when to try again, or the zero time if the destination rejected
+// the file or the attempts are used up.
+func deliver(ctx context.Context, remote config.RemoteConfig, dest config.RemoteConfig, absPath string, modTime int64, logger Logger) (bool, time.Time) {
+	uploader, err := api.UploaderFor(dest)
+	if err != nil {
+		return false, deliveryFailed(remote, dest, absPath, modTime, &api.UploadError{Class: api.ClassPermanent, Err: err}, logger)
+	}
+
+	// A destination known to be down is not charged for the wait, as for the
+	// remote's own endpoint
+	if api.BreakerState(dest.Endpoint) == api.BreakerOpen {
+		next := time.Now().Add(retryScheduleBase)
+		if dest.Optional {
+			db.ScheduleDestination(absPath, dest.Name, remote.Name, modTime, next)
+		}
+		debugLog(logger, "[%s] Endpoint unavailable. Holding delivery of %s.", dest.Name, filepath.Base(absPath))
+		return false, next
+	}
+
+	delivered := false
+	var next time.Time
+	onSuccess := func(path string, hash string, modTime int64, r api.Receipt) {
+		db.MarkDelivered(path, dest.Name, remote.Name, modTime, hash, r.DocumentID)
+		delivered = true
+	}
+	onError := func(path string, err error) {
+		next = deliveryFailed(remote, dest, path, modTime, err, logger)
+	}
+	uploader.Upload(ctx, dest, absPath, modTime, onSuccess, onError, func(f string, v ...interface{}) {
+		if logger != nil {
+			logger.Warningf(f, v...)
+		}
+	})
+
+	if delivered && logger != nil {
+		logger.Infof("[%s] Delivered: %s", dest.Name, filepath.Base(absPath))
+	}
+	if !delivered && next.IsZero() && ctx.Err() != nil {
+		// Shutting down. Try again on the next start.
+		next = time.Now()
+		if dest.Optional {
+			db.ScheduleDestination(absPath, dest.Name, remote.Name, modTime, next)
+		}
+	}
+	return delivered, next
+}
+
+// deliveryFailed records a failed delivery and schedules the next attempt
+// with the same backoff as uploads to the remote itself. Rejected files and
+// destinations that keep failing are marked FAILED and not retried.
+func deliveryFailed(remote config.RemoteConfig, dest config.RemoteConfig, absPath string, modTime int64, err error, logger Logger) time.Time {
+	uerr := api.Classify(err)
+	healthFor(remote.Name).failed(fmt.Errorf("%s: %w", dest.Name, uerr))
+
+	if uerr.Class == api.ClassPermanent {
+		db.DestinationFailed(absPath, dest.Name, remote.Name, modTime, db.StatusFailed)
+		if logger != nil {
+			logger.Errorf("[%s] %s rejected: %v", dest.Name, filepath.Base(absPath), uerr)
+		}
+		return time.Time{}
+	}
+
+	count := db.DestinationFailed(absPath, dest.Name, remote.Name, modTime, db.StatusPending)
+	if count > maxErrorCount {
+		db.DestinationFailed(absPath, dest.Name, remote.Name, modTime, db.StatusFailed)
+		if logger != nil {
+			logger.Errorf("[%s] Giving up on %s after %d failed attempts.", dest.Name, filepath.Base(absPath), count)
+		}
+		return time.Time{}
+	}
+
+	delay := retryDelay(count)
+	if uerr.RetryAfter > delay {
+		delay = uerr.RetryAfter
+	}
+	next := time.Now().Add(delay)
+	// Files still waiting in the watch folder are retried with the file
+	if dest.Optional {
+		db.ScheduleDestination(absPath, dest.Name, remote.Name, modTime, next)
+	}
+	debugLog(logger, "[%s] Delivery of %s failed %d time(s). Next attempt in %s.", dest.Name, filepath.Base(absPath), count, delay)
+	return next
+}
+
+// retryDeliveries retries optional deliveries whose schedule is due. Only
+// files already in .done are retried here, files still in the watch folder
+// get their next attempt when the file is processed again.
+func retryDeliveries(ctx context.Context, remote config.RemoteConfig, live *liveConfig, logger Logger) {
+	targets := make(map[string]config.RemoteConfig)
+	for _, dest := range remote.Targets() {
+		targets[dest.Name] = dest
+	}
+
+	for _, due := range db.DueDeliveries(remote.Name, time.Now()) {
+		dest, ok := targets[due.Destination]
+		if !ok || filepath.Base(filepath.Dir(due.Path)) != ".done" {
+			continue
+		}
+		db.ScheduleDestination(due.Path, dest.Name, remote.Name, due.ModTime, time.Time{})
+		if _, err := os.Stat(due.Path); err != nil {
+			if logger != nil {
+				logger.Warningf("[%s] %s is no longer in .done. Dropping its delivery.", dest.Name, filepath.Base(due.Path))
+			}
+			db.DestinationFailed(due.Path, dest.Name, remote.Name, due.ModTime, db.StatusFailed)
+			continue
+		}
+
+		go func(dest config.RemoteConfig, due db.DueDelivery) {
+			live.slots.acquire()
+			defer live.slots.release()
+			deliver(ctx, remote, dest, due.Path, due.ModTime, logger)
+		}(dest, due)
+	}
+}
@@ -0,0 +1,167 @@
+package core
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/cleverdata/sift-agent/internal/db"
+)
+
+// siftDestination is a Sift server answering every upload with status, which
+// can be changed between attempts.
+func siftDestination(t *testing.T, name string, optional bool, status int) (config.RemoteConfig, *atomic.Int32) {
+	t.Helper()
+	code := new(atomic.Int32)
+	code.Store(int32(status))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(int(code.Load()))
+	}))
+	t.Cleanup(srv.Close)
+	return config.RemoteConfig{Name: name, Endpoint: srv.URL, Key: "k", Optional: optional, RetryAttempts: 1}, code
+}
+
+// fanOut sets up a watch folder with one file and a remote delivering it to
+// dests.
+func fanOut(t *testing.T, dests ...config.RemoteConfig) (config.RemoteConfig, string, int64) {
+	t.Helper()
+	initDB(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "invoice.pdf")
+	if err := os.WriteFile(path, []byte("invoice"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(path)
+	remote := config.RemoteConfig{Name: filepath.Base(dir), Path: dir, Destinations: dests}
+	return remote, path, info.ModTime().UnixNano()
+}
+
+func movedTo(t *testing.T, path string) string {
+	t.Helper()
+	for _, dir := range []string{".done", ".quarantine"} {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(path), dir, filepath.Base(path))); err == nil {
+			return dir
+		}
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal("file lost")
+	}
+	return ""
+}
+
+func TestArchiveRequiredRejected(t *testing.T) {
+	dest, _ := siftDestination(t, "mirror", false, http.StatusUnprocessableEntity)
+	remote, path, modTime := fanOut(t, dest)
+
+	archive(context.Background(), remote, path, modTime, nil)
+	if got := movedTo(t, path); got != ".quarantine" {
+		t.Fatalf("file rejected by a required destination moved to %q", got)
+	}
+	if status := db.DestinationStatus(path, remote.Targets()[0].Name, modTime); status != db.StatusFailed {
+		t.Fatalf("delivery recorded as %q", status)
+	}
+}
+
+func TestArchiveRequiredFailedEarlier(t *testing.T) {
+	dest, _ := siftDestination(t, "mirror", false, http.StatusCreated)
+	remote, path, modTime := fanOut(t, dest)
+	db.DestinationFailed(path, remote.Targets()[0].Name, remote.Name, modTime, db.StatusFailed)
+
+	archive(context.Background(), remote, path, modTime, nil)
+	if got := movedTo(t, path); got != ".quarantine" {
+		t.Fatalf("file refused earlier moved to %q", got)
+	}
+}
+
+func TestArchiveOptionalFailed(t *testing.T) {
+	dest, _ := siftDestination(t, "backup", true, http.StatusServiceUnavailable)
+	remote, path, modTime := fanOut(t, dest)
+
+	archive(context.Background(), remote, path, modTime, nil)
+	if got := movedTo(t, path); got != ".done" {
+		t.Fatalf("file with a failed optional destination moved to %q", got)
+	}
+	due := db.DueDeliveries(remote.Name, time.Now().Add(time.Hour))
+	if len(due) != 1 || due[0].Path != filepath.Join(filepath.Dir(path), ".done", "invoice.pdf") {
+		t.Fatalf("optional delivery not rescheduled from .done: %+v", due)
+	}
+}
+
+func TestArchiveMixed(t *testing.T) {
+	// A rejected optional destination does not hold the file back
+	mirror, _ := siftDestination(t, "mirror", false, http.StatusCreated)
+	backup, _ := siftDestination(t, "backup", true, http.StatusUnprocessableEntity)
+	remote, path, modTime := fanOut(t, mirror, backup)
+	archive(context.Background(), remote, path, modTime, nil)
+	if got := movedTo(t, path); got != ".done" {
+		t.Fatalf("file delivered to its required destination moved to %q", got)
+	}
+
+	// A required destination that is down holds it until its retry
+	mirror, _ = siftDestination(t, "mirror", false, http.StatusCreated)
+	standby, _ := siftDestination(t, "standby", false, http.StatusServiceUnavailable)
+	remote, path, modTime = fanOut(t, mirror, standby)
+	archive(context.Background(), remote, path, modTime, nil)
+	if got := movedTo(t, path); got != "" {
+		t.Fatalf("file held for a required destination moved to %q", got)
+	}
+	if due := db.DueRetries(remote.Name, time.Now().Add(time.Hour)); len(due) != 1 || due[0] != path {
+		t.Fatalf("held file not scheduled for retry: %v", due)
+	}
+	if status := db.DestinationStatus(path, remote.Targets()[0].Name, modTime); status != db.StatusUploaded {
+		t.Fatalf("delivery to the available destination recorded as %q", status)
+	}
+}
+
+func TestDeliverRecordsOutcome(t *testing.T) {
+	dest, code := siftDestination(t, "backup", true, http.StatusServiceUnavailable)
+	remote, path, modTime := fanOut(t, dest)
+	target := remote.Targets()[0]
+
+	ok, next := deliver(context.Background(), remote, target, path, modTime, nil)
+	if ok || next.IsZero() {
+		t.Fatalf("failed delivery returned %v, next attempt %v", ok, next)
+	}
+	code.Store(http.StatusCreated)
+	if ok, _ := deliver(context.Background(), remote, target, path, modTime, nil); !ok {
+		t.Fatal("delivery failed")
+	}
+	if status := db.DestinationStatus(path, target.Name, modTime); status != db.StatusUploaded {
+		t.Fatalf("delivery recorded as %q", status)
+	}
+	if due := db.DueDeliveries(remote.Name, time.Now().Add(time.Hour)); len(due) != 0 {
+		t.Fatalf("delivered file still scheduled: %+v", due)
+	}
+}
+
+func TestRetryDeliveriesFromDone(t *testing.T) {
+	dest, code := siftDestination(t, "backup", true, http.StatusServiceUnavailable)
+	remote, path, modTime := fanOut(t, dest)
+	target := remote.Targets()[0]
+	archive(context.Background(), remote, path, modTime, nil)
+	done := filepath.Join(filepath.Dir(path), ".done", "invoice.pdf")
+
+	// Not yet due
+	retryDeliveries(context.Background(), remote, liveFor(remote), nil)
+	time.Sleep(100 * time.Millisecond)
+	if status := db.DestinationStatus(done, target.Name, modTime); status == db.StatusUploaded {
+		t.Fatal("delivery retried before it was due")
+	}
+
+	code.Store(http.StatusCreated)
+	db.ScheduleDestination(done, target.Name, remote.Name, modTime, time.Now().Add(-time.Second))
+	retryDeliveries(context.Background(), remote, liveFor(remote), nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for db.DestinationStatus(done, target.Name, modTime) != db.StatusUploaded {
+		if time.Now().After(deadline) {
+			t.Fatal("due delivery not retried from .done")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"github.com/cleverdata/sift-agent/internal/api"
 	"github.com/cleverdata/sift-agent/internal/config"
 	"github.com/cleverdata/sift-agent/internal/db"
+	"github.com/cleverdata/sift-agent/internal/metrics"
+	"github.com/dustin/go-humanize"
 	"github.com/fsnotify/fsnotify"
 )
 
@@ -37,7 +39,9 @@ func debugLog(logger Logger, format string, v ...interface{}) {
 	}
 }
 
-func WatchRemote(ctx context.Context, remote config.RemoteConfig, logger Logger) {
+// WatchRemote runs the pipeline of a remote until ctx ends. onStarted, if set,
+// is called once the initial scan has been queued.
+func WatchRemote(ctx context.Context, remote config.RemoteConfig, logger Logger, onStarted func()) {
 	msg := fmt.Sprintf("[%s] Starting watcher on: %s", remote.Name, remote.Path)
 	if logger != nil {
 		logger.Info(msg)
@@ -54,12 +58,16 @@ func WatchRemote(ctx context.Context, remote config.RemoteConfig, logger Logger)
 
 	// --- PIPELINE CHANNELS ---
 	type event struct {
-		path string
-		size int64
-		mod  int64
+		path   string
+		size   int64
+		mod    int64
+		source string // fsnotify, poll or retry
 	}
 	eventChan := make(chan event, 100)
 	doneChan := make(chan string, 100)
+	uploadGate := &gate{}
+	stats := healthFor(remote.Name)
+	live := liveFor(remote)
 
 	// --- ORCHESTRATOR ---
 	// Single goroutine that manages processing state and timers
@@ -67,17 +75,6 @@ func WatchRemote(ctx context.Context, remote config.RemoteConfig, logger Logger)
 		activeProcessing := make(map[string]bool)
 		pendingStates := make(map[string]*fileState)
 
-		limit := remote.ConcurrencyLimit
-		if limit <= 0 {
-			limit = 5
-		}
-		semaphore := make(chan struct{}, limit)
-
-		settling, err := time.ParseDuration(remote.SettlingDelay)
-		if err != nil {
-			settling = 5 * time.Second
-		}
-
 		for {
 			select {
 			case e := <-eventChan:
@@ -97,7 +94,7 @@ func WatchRemote(ctx context.Context, remote config.RemoteConfig, logger Logger)
 
 						// Start a fresh timer
 						pathCopy := e.path // Capture for closure
-						state.timer = time.AfterFunc(settling, func() {
+						state.timer = time.AfterFunc(settlingDelay(live.get()), func() {
 							// Move from Pending to Active
 							doneChan <- "START:" + pathCopy
 						})
@@ -106,12 +103,13 @@ func WatchRemote(ctx context.Context, remote config.RemoteConfig, logger Logger)
 					}
 				} else {
 					debugLog(logger, "New file discovered: %s (%d bytes). Starting settling timer.", filepath.Base(e.path), e.size)
+					metrics.FilesDiscovered.Inc(remote.Name, e.source)
 					newState := &fileState{
 						lastSize: e.size,
 						lastMod:  e.mod,
 					}
 					pathCopy := e.path
-					newState.timer = time.AfterFunc(settling, func() {
+					newState.timer = time.AfterFunc(settlingDelay(live.get()), func() {
 						doneChan <- "START:" + pathCopy
 					})
 					pendingStates[e.path] = newState
@@ -127,15 +125,17 @@ func WatchRemote(ctx context.Context, remote config.RemoteConfig, logger Logger)
 
 					// Dispatch to worker pool
 					go func(p string) {
-						semaphore <- struct{}{} // Acquire slot
+						live.slots.acquire()
+						stats.addInFlight(1)
 						debugLog(logger, "Worker slot ACQUIRED for %s", filepath.Base(p))
 
 						defer func() {
-							<-semaphore // Release slot
+							stats.addInFlight(-1)
+							live.slots.release()
 							debugLog(logger, "Worker slot RELEASED for %s", filepath.Base(p))
 							doneChan <- "FINISH:" + p
 						}()
-						handleUpload(ctx, remote, p, logger)
+						handleUpload(ctx, live.get(), p, uploadGate, logger)
 					}(path)
 				} else if strings.HasPrefix(msg, "FINISH:") {
 					path := strings.TrimPrefix(msg, "FINISH:")
@@ -146,11 +146,12 @@ func WatchRemote(ctx context.Context, remote config.RemoteConfig, logger Logger)
 			case <-ctx.Done():
 				return
 			}
+			stats.setQueue(len(pendingStates), len(activeProcessing))
 		}
 	}()
 
 	// Helper to probe a file and send an event
-	probeAndSend := func(path string) {
+	probeAndSend := func(path string, source string) {
 		info, err := os.Stat(path)
 		if err != nil || info.IsDir() {
 			return
@@ -161,17 +162,23 @@ func WatchRemote(ctx context.Context, remote config.RemoteConfig, logger Logger)
 
 		abs, _ := filepath.Abs(path)
 		eventChan <- event{
-			path: abs,
-			size: info.Size(),
-			mod:  info.ModTime().UnixNano(),
+			path:   abs,
+			size:   info.Size(),
+			mod:    info.ModTime().UnixNano(),
+			source: source,
 		}
 	}
 
 	// --- INPUT SOURCE 1: FSNOTIFY (Real-time) ---
 	if !remote.DisableFsnotify {
+		stats.setMode("fsnotify")
 		go func() {
 			watcher, err := fsnotify.NewWatcher()
 			if err != nil {
+				stats.setMode("polling")
+				if logger != nil {
+					logger.Warningf("[%s] FSNOTIFY unavailable (%v). Falling back to polling.", remote.Name, err)
+				}
 				return
 			}
 			defer watcher.Close()
@@ -185,7 +192,7 @@ func WatchRemote(ctx context.Context, remote config.RemoteConfig, logger Logger)
 					}
 					if e.Op&(fsnotify.Create|fsnotify.Write) != 0 {
 						debugLog(logger, "FSNOTIFY event (%v) for %s", e.Op, filepath.Base(e.Name))
-						probeAndSend(e.Name)
+						probeAndSend(e.Name, "fsnotify")
 					}
 				case <-ctx.Done():
 					return
@@ -193,6 +200,7 @@ func WatchRemote(ctx context.Context, remote config.RemoteConfig, logger Logger)
 			}
 		}()
 	} else {
+		stats.setMode("polling")
 		if logger != nil {
 			logger.Infof("[%s] FSNOTIFY disabled. Running in polling-only mode.", remote.Name)
 		}
@@ -200,22 +208,43 @@ func WatchRemote(ctx context.Context, remote config.RemoteConfig, logger Logger)
 
 	// Poller
 	go func() {
-		pollInterval, err := time.ParseDuration(remote.PollingInterval)
-		if err != nil {
-			pollInterval = 1 * time.Minute
+		// The interval is re-read every cycle so server overrides apply live
+		timer := time.NewTimer(pollingInterval(live.get()))
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-timer.C:
+				debugLog(logger, "[%s] Starting backup directory scan...", remote.Name)
+				files, _ := os.ReadDir(remote.Path)
+				for _, f := range files {
+					probeAndSend(filepath.Join(remote.Path, f.Name()), "poll")
+				}
+				timer.Reset(pollingInterval(live.get()))
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
 
-		ticker := time.NewTicker(pollInterval)
+	// Retry scheduler: requeues files whose backoff has expired, independent
+	// of the poller and fsnotify
+	go func() {
+		ticker := time.NewTicker(retrySchedulerInterval)
 		defer ticker.Stop()
 
 		for {
 			select {
 			case <-ticker.C:
-				debugLog(logger, "[%s] Starting backup directory scan...", remote.Name)
-				files, _ := os.ReadDir(remote.Path)
-				for _, f := range files {
-					probeAndSend(filepath.Join(remote.Path, f.Name()))
+				for _, path := range db.DueRetries(remote.Name, time.Now()) {
+					db.ClearRetry(path)
+					if _, err := os.Stat(path); err != nil {
+						continue
+					}
+					debugLog(logger, "[%s] Scheduled retry due for %s. Requeueing.", remote.Name, filepath.Base(path))
+					probeAndSend(path, "retry")
 				}
+				retryDeliveries(ctx, live.get(), live, logger)
 			case <-ctx.Done():
 				return
 			}
@@ -225,28 +254,63 @@ func WatchRemote(ctx context.Context, remote config.RemoteConfig, logger Logger)
 	// Initial scan
 	files, _ := os.ReadDir(remote.Path)
 	for _, f := range files {
-		probeAndSend(filepath.Join(remote.Path, f.Name()))
+		probeAndSend(filepath.Join(remote.Path, f.Name()), "poll")
+	}
+	if onStarted != nil {
+		onStarted()
 	}
 
 	<-ctx.Done()
 }
 
-func handleUpload(ctx context.Context, remote config.RemoteConfig, absPath string, logger Logger) {
+func handleUpload(ctx context.Context, remote config.RemoteConfig, absPath string, uploadGate *gate, logger Logger) {
 	info, err := os.Stat(absPath)
 	if err != nil {
 		return
 	}
 
-	status, dbModTime, _, errorCount := db.GetFileRecord(absPath)
-	if errorCount > 10 {
+	uploader, err := api.UploaderFor(remote)
+	if err != nil {
+		if logger != nil {
+			logger.Errorf("[%s] Cannot upload %s: %v", remote.Name, filepath.Base(absPath), err)
+		}
+		return
+	}
+
+	status, dbModTime, dbHash, errorCount := db.GetFileRecord(absPath)
+	if errorCount > maxErrorCount {
 		return
 	}
 
-	if (status == db.StatusUploaded || status == db.StatusVerified) && dbModTime == info.ModTime().UnixNano() {
-		moveToDone(absPath, remote, logger)
+	// Unchanged files wait for their scheduled retry. New content goes right away.
+	if at, scheduled := db.NextAttempt(absPath); scheduled && time.Now().Before(at) && dbModTime == info.ModTime().UnixNano() {
+		debugLog(logger, "Retry for %s scheduled at %s. Skipping.", filepath.Base(absPath), at.Format(time.TimeOnly))
 		return
 	}
 
+	// While the endpoint is down, hold here instead of running the stability
+	// loop and spending upload attempts on it.
+	if state := api.BreakerState(remote.Endpoint); state != api.BreakerClosed {
+		debugLog(logger, "[%s] Endpoint circuit %s. Holding %s.", remote.Name, state, filepath.Base(absPath))
+	}
+	if !api.AwaitEndpoint(ctx, remote.Endpoint) {
+		return
+	}
+
+	if dbModTime == info.ModTime().UnixNano() {
+		switch status {
+		case db.StatusVerified, db.StatusDuplicate:
+			archive(ctx, remote, absPath, dbModTime, logger)
+			return
+		case db.StatusUploaded:
+			// Transferred earlier but never confirmed. Verify without re-sending.
+			remoteID, size := db.GetUploadRecord(absPath)
+			if settleVerification(ctx, remote, absPath, remoteID, dbHash, size, dbModTime, logger) != db.StatusCorrupt {
+				return
+			}
+		}
+	}
+
 	// --- STABILITY LOOP (Final Verification) ---
 	threshold := remote.StabilityThreshold
 	if threshold <= 0 {
@@ -307,38 +371,314 @@ func handleUpload(ctx context.Context, remote config.RemoteConfig, absPath strin
 		}
 	}
 
-	if logger != nil {
-		logger.Infof("[%s] Uploading: %s", remote.Name, filepath.Base(absPath))
+	metrics.FilesSettled.Inc(remote.Name)
+	metrics.StabilityDuration.Observe(time.Since(startTime).Seconds(), remote.Name)
+
+	duplicate, hash := handleDuplicate(ctx, remote, absPath, info.ModTime().UnixNano(), lastSize, logger)
+	if duplicate {
+		return
+	}
+	uploadCtx := ctx
+	if hash != "" {
+		// The content checked for duplicates is the content uploaded and recorded
+		uploadCtx = api.WithContentHash(ctx, hash)
+	}
+
+	if remaining, reason := uploadGate.status(); remaining > 0 {
+		debugLog(logger, "[%s] Uploads paused (%s). Holding %s for %s.", remote.Name, reason, filepath.Base(absPath), remaining.Round(time.Second))
+	}
+	if !uploadGate.wait(ctx) {
+		return
+	}
+
+	// A CORRUPT verification re-uploads immediately, a bounded number of times.
+	for attempt := 1; attempt <= maxCorruptRetries; attempt++ {
+		if logger != nil {
+			logger.Infof("[%s] Uploading: %s", remote.Name, filepath.Base(absPath))
+		}
+
+		uploaded := false
+		var localHash string
+		var receipt api.Receipt
+
+		onSuccess := func(path string, hash string, modTime int64, r api.Receipt) {
+			db.MarkUploaded(path, remote.Endpoint, hash, modTime, lastSize, r.DocumentID)
+			healthFor(remote.Name).uploaded()
+			uploaded = true
+			localHash = hash
+			receipt = r
+		}
+
+		onError := func(path string, err error) {
+			handleUploadError(remote, path, info.ModTime().UnixNano(), lastSize, err, uploadGate, logger)
+		}
+
+		started := time.Now()
+		uploader.Upload(uploadCtx, remote, absPath, info.ModTime().UnixNano(), onSuccess, onError, func(f string, v ...interface{}) {
+			if logger != nil {
+				logger.Warningf(f, v...)
+			}
+		})
+
+		if !uploaded {
+			if ctx.Err() == nil {
+				metrics.UploadDuration.Observe(time.Since(started).Seconds(), remote.Name, "failure")
+			}
+			return
+		}
+		metrics.UploadDuration.Observe(time.Since(started).Seconds(), remote.Name, "success")
+		metrics.UploadBytes.Observe(float64(lastSize), remote.Name)
+		metrics.FilesUploaded.Inc(remote.Name)
+		if receipt.Encoding != "" && logger != nil && receipt.RawBytes > 0 {
+			saved := 100 * float64(receipt.RawBytes-receipt.WireBytes) / float64(receipt.RawBytes)
+			logger.Infof("[%s] Compressed %s with %s: %s -> %s (%.0f%% saved)", remote.Name, filepath.Base(absPath), receipt.Encoding,
+				humanize.IBytes(uint64(receipt.RawBytes)), humanize.IBytes(uint64(receipt.WireBytes)), saved)
+		}
+		if receipt.AlreadyStored {
+			db.MarkVerified(absPath)
+			archive(ctx, remote, absPath, info.ModTime().UnixNano(), logger)
+			return
+		}
+		if settleVerification(ctx, remote, absPath, receipt.DocumentID, localHash, lastSize, info.ModTime().UnixNano(), logger) != db.StatusCorrupt {
+			return
+		}
+	}
+}
+
+const (
+	maxCorruptRetries  = 3
+	verifyAttempts     = 5
+	verifyPollInterval = 3 * time.Second
+	verifyRecheck      = 5 * time.Minute
+	authPause          = 5 * time.Minute
+	throttlePause      = 1 * time.Minute
+
+	// Files that keep failing are retried on a persistent schedule, doubling
+	// from retryScheduleBase, and abandoned after maxErrorCount failures.
+	maxErrorCount          = 10
+	retryScheduleBase      = 1 * time.Minute
+	retryScheduleMax       = 1 * time.Hour
+	retrySchedulerInterval = 15 * time.Second
+)
+
+func settlingDelay(remote config.RemoteConfig) time.Duration {
+	settling, err := time.ParseDuration(remote.SettlingDelay)
+	if err != nil {
+		return 5 * time.Second
 	}
+	return settling
+}
 
-	onSuccess := func(path string, hash string, modTime int64) {
-		db.UpdateFileStatus(path, db.StatusVerified, hash, modTime, 0)
-		moveToDone(path, remote, logger)
+func pollingInterval(remote config.RemoteConfig) time.Duration {
+	interval, err := time.ParseDuration(remote.PollingInterval)
+	if err != nil || interval <= 0 {
+		return 1 * time.Minute
+	}
+	return interval
+}
+
+// handleUploadError reacts to a classified upload failure. Only transient
+// failures count against the file's error budget, and not while the endpoint's
+// circuit is open. Auth and throttling problems
+// pause the whole remote, and files the server rejects outright are quarantined.
+func handleUploadError(remote config.RemoteConfig, absPath string, modTime int64, size int64, err error, uploadGate *gate, logger Logger) {
+	uerr := api.Classify(err)
+	healthFor(remote.Name).failed(uerr)
+	metrics.FilesFailed.Inc(remote.Name, uerr.Class.String())
+
+	switch uerr.Class {
+	case api.ClassPermanent:
+		if logger != nil {
+			logger.Errorf("[%s] %s rejected by server: %v", remote.Name, filepath.Base(absPath), uerr)
+		}
+		db.MarkFailed(absPath, remote.Endpoint, modTime, size)
+		quarantine(absPath, remote, logger)
+	case api.ClassAuth:
+		uploadGate.pause(authPause, "authentication rejected")
+		db.ScheduleRetry(absPath, remote.Name, modTime, time.Now().Add(authPause))
+		if logger != nil {
+			logger.Errorf("[%s] Authentication rejected (status %d). Pausing uploads for %s.", remote.Name, uerr.Status, authPause)
+		}
+	case api.ClassThrottled:
+		wait := uerr.RetryAfter
+		if wait <= 0 {
+			wait = throttlePause
+		}
+		uploadGate.pause(wait, "throttled by server")
+		db.ScheduleRetry(absPath, remote.Name, modTime, time.Now().Add(wait))
+		if logger != nil {
+			logger.Warningf("[%s] Server is throttling uploads. Pausing for %s.", remote.Name, wait.Round(time.Second))
+		}
+	default:
+		recordFailure(remote, absPath, modTime, logger)
 	}
+}
 
-	onError := func(path string) {
-		db.IncrementError(path)
+// recordFailure charges a failed attempt to the file and schedules the next
+// one with exponential backoff, until the error budget is spent. Failures while
+// the endpoint's circuit is open are the endpoint's, not the file's, so the
+// file is only rescheduled.
+func recordFailure(remote config.RemoteConfig, absPath string, modTime int64, logger Logger) {
+	if api.BreakerState(remote.Endpoint) != api.BreakerClosed {
+		db.ScheduleRetry(absPath, remote.Name, modTime, time.Now().Add(retryScheduleBase))
+		if logger != nil {
+			logger.Warningf("[%s] Endpoint unavailable. Holding %s until it recovers.", remote.Name, filepath.Base(absPath))
+		}
+		return
 	}
 
-	api.UploadFile(ctx, remote, absPath, info.ModTime().UnixNano(), onSuccess, onError, func(f string, v ...interface{}) {
+	count := db.IncrementError(absPath, remote.Name, modTime)
+	if count > maxErrorCount {
+		db.ClearRetry(absPath)
 		if logger != nil {
-			logger.Warningf(f, v...)
+			logger.Errorf("[%s] Giving up on %s after %d failed attempts.", remote.Name, filepath.Base(absPath), count)
 		}
-	})
+		return
+	}
+
+	delay := retryDelay(count)
+	db.ScheduleRetry(absPath, remote.Name, modTime, time.Now().Add(delay))
+	debugLog(logger, "[%s] %s failed %d time(s). Next attempt in %s.", remote.Name, filepath.Base(absPath), count, delay)
 }
 
-func moveToDone(absPath string, remote config.RemoteConfig, logger Logger) {
-	doneDir := filepath.Join(filepath.Dir(absPath), ".done")
-	os.MkdirAll(doneDir, 0755)
+// retryDelay is the backoff after the count-th consecutive failure.
+func retryDelay(count int) time.Duration {
+	if count-1 < 16 && retryScheduleBase<<(count-1) < retryScheduleMax {
+		return retryScheduleBase << (count - 1)
+	}
+	return retryScheduleMax
+}
 
-	dest := filepath.Join(doneDir, filepath.Base(absPath))
-	if _, err := os.Stat(dest); err == nil {
-		dest = filepath.Join(doneDir, fmt.Sprintf("%d_%s", time.Now().Unix(), filepath.Base(absPath)))
+// settleVerification confirms an upload with the server and records the
+// outcome. VERIFIED files are archived, CORRUPT ones are left for re-upload,
+// and UPLOADED means the server has not finished ingesting yet.
+func settleVerification(ctx context.Context, remote config.RemoteConfig, absPath string, documentID string, hash string, size int64, modTime int64, logger Logger) string {
+	if documentID == "" || !api.HasCapability(remote.Endpoint, api.CapVerify) {
+		// Server cannot confirm ingestion. Trust the 2xx as before.
+		debugLog(logger, "Server does not support verification. Accepting %s as verified.", filepath.Base(absPath))
+		db.MarkVerified(absPath)
+		archive(ctx, remote, absPath, modTime, logger)
+		return db.StatusVerified
+	}
+
+	for i := 0; i < verifyAttempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(verifyPollInterval):
+			case <-ctx.Done():
+				return db.StatusUploaded
+			}
+		}
+
+		server, err := api.VerifyUpload(ctx, remote, documentID)
+		if err == api.ErrNotReady {
+			debugLog(logger, "Verification pending for %s (%d/%d)", filepath.Base(absPath), i+1, verifyAttempts)
+			continue
+		}
+		if err != nil {
+			if logger != nil {
+				logger.Warningf("[%s] Verification failed for %s: %v", remote.Name, filepath.Base(absPath), err)
+			}
+			db.ScheduleRetry(absPath, remote.Name, modTime, time.Now().Add(verifyRecheck))
+			return db.StatusUploaded
+		}
+
+		// The server holds the ciphertext of encrypted files. Its digest was
+		// checked in transit and is not kept, only the size can be compared.
+		expectHash, expectSize := hash, size
+		if api.Encrypts(remote) {
+			expectHash, expectSize = server.SHA256, api.SealedSize(size)
+		}
+		if !strings.EqualFold(server.SHA256, expectHash) || server.Size != expectSize {
+			if logger != nil {
+				logger.Errorf("[%s] CORRUPT: %s server reported sha256 %s (%d bytes), local sha256 %s (%d bytes). Re-uploading.",
+					remote.Name, filepath.Base(absPath), server.SHA256, server.Size, expectHash, expectSize)
+			}
+			db.MarkCorrupt(absPath)
+			metrics.FilesFailed.Inc(remote.Name, "corrupt")
+			healthFor(remote.Name).failed(fmt.Errorf("%s failed verification: sha256 mismatch", filepath.Base(absPath)))
+			recordFailure(remote, absPath, modTime, logger)
+			return db.StatusCorrupt
+		}
+
+		db.MarkVerified(absPath)
+		archive(ctx, remote, absPath, modTime, logger)
+		return db.StatusVerified
+	}
+
+	db.ScheduleRetry(absPath, remote.Name, modTime, time.Now().Add(verifyRecheck))
+	if logger != nil {
+		logger.Infof("[%s] %s uploaded, server has not confirmed ingestion yet. Will verify again in %s.", remote.Name, filepath.Base(absPath), verifyRecheck)
+	}
+	return db.StatusUploaded
+}
+
+// handleDuplicate applies the remote's dedup policy. It returns true when the
+// file was matched against an earlier upload and needs no further processing,
+// and the file's hash if it computed one, for the upload to reuse.
+func handleDuplicate(ctx context.Context, remote config.RemoteConfig, absPath string, modTime int64, size int64, logger Logger) (bool, string) {
+	policy := strings.ToLower(remote.DedupPolicy)
+	if policy != config.DedupSkip && policy != config.DedupReference {
+		return false, ""
+	}
+
+	hash, err := api.HashFile(absPath)
+	if err != nil {
+		debugLog(logger, "Dedup hash failed for %s: %v", filepath.Base(absPath), err)
+		return false, ""
+	}
+
+	original, found := db.FindByHash(hash, remote.Endpoint, absPath)
+	if !found {
+		return false, hash
+	}
+
+	if policy == config.DedupReference {
+		if err := api.UploadReference(ctx, remote, absPath, hash, modTime); err != nil {
+			if logger != nil {
+				logger.Warningf("[%s] Duplicate reference failed for %s: %v", remote.Name, filepath.Base(absPath), err)
+			}
+			recordFailure(remote, absPath, modTime, logger)
+			return true, hash
+		}
+	}
+
+	if logger != nil {
+		logger.Infof("[%s] Duplicate: %s has the same content as %s (%s). Archiving without upload.", remote.Name, filepath.Base(absPath), original, policy)
+	}
+	db.MarkDuplicate(absPath, remote.Endpoint, hash, modTime, size, original)
+	archive(ctx, remote, absPath, modTime, logger)
+	return true, hash
+}
+
+// moveToDone archives the file and returns its new path.
+func moveToDone(absPath string, remote config.RemoteConfig, logger Logger) (string, bool) {
+	dest, ok := moveInto(absPath, ".done")
+	if ok && logger != nil {
+		logger.Infof("[%s] Success: %s moved to .done", remote.Name, filepath.Base(absPath))
 	}
+	return dest, ok
+}
 
-	if err := os.Rename(absPath, dest); err == nil {
+func quarantine(absPath string, remote config.RemoteConfig, logger Logger) {
+	if _, ok := moveInto(absPath, ".quarantine"); ok {
+		metrics.FilesQuarantined.Inc(remote.Name)
 		if logger != nil {
-			logger.Infof("[%s] Success: %s moved to .done", remote.Name, filepath.Base(absPath))
+			logger.Errorf("[%s] Quarantined: %s moved to .quarantine", remote.Name, filepath.Base(absPath))
 		}
 	}
-}
\ No newline at end of file
+}
+
+// moveInto moves the file into a sibling directory, prefixing a timestamp if
+// the name is already taken there, and returns its new path.
+func moveInto(absPath string, dirName string) (string, bool) {
+	targetDir := filepath.Join(filepath.Dir(absPath), dirName)
+	os.MkdirAll(targetDir, 0755)
+
+	dest := filepath.Join(targetDir, filepath.Base(absPath))
+	if _, err := os.Stat(dest); err == nil {
+		dest = filepath.Join(targetDir, fmt.Sprintf("%d_%s", time.Now().Unix(), filepath.Base(absPath)))
+	}
+
+	return dest, os.Rename(absPath, dest) == nil
+}
@@ -0,0 +1,51 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/cleverdata/sift-agent/internal/db"
+)
+
+func TestScheduledFileWaitsForItsRetry(t *testing.T) {
+	initDB(t)
+	watched, endpoint := t.TempDir(), t.TempDir()
+	remote := config.RemoteConfig{Name: "scheduled", Type: config.TypeDir, Path: watched, Endpoint: endpoint,
+		StabilityThreshold: 1, CheckInterval: "10ms"}
+	drop := func(name string) (string, int64) {
+		path := filepath.Join(watched, name)
+		os.WriteFile(path, []byte("quarterly report"), 0o644)
+		info, _ := os.Stat(path)
+		return path, info.ModTime().UnixNano()
+	}
+	uploaded := func(name string) bool {
+		_, err := os.Stat(filepath.Join(endpoint, name))
+		return err == nil
+	}
+
+	path, modTime := drop("report.pdf")
+	db.IncrementError(path, remote.Name, modTime)
+	db.ScheduleRetry(path, remote.Name, modTime, time.Now().Add(time.Hour))
+	handleUpload(context.Background(), remote, path, &gate{}, nil)
+	if uploaded("report.pdf") {
+		t.Fatal("file uploaded before its scheduled retry")
+	}
+
+	db.ScheduleRetry(path, remote.Name, modTime, time.Now().Add(-time.Second))
+	handleUpload(context.Background(), remote, path, &gate{}, nil)
+	if !uploaded("report.pdf") {
+		t.Fatal("file not uploaded once its retry was due")
+	}
+
+	// New content does not wait for the schedule of the old
+	path, modTime = drop("draft.pdf")
+	db.ScheduleRetry(path, remote.Name, modTime-int64(time.Hour), time.Now().Add(time.Hour))
+	handleUpload(context.Background(), remote, path, &gate{}, nil)
+	if !uploaded("draft.pdf") {
+		t.Fatal("changed file held for the retry of its old content")
+	}
+}
@@ -0,0 +1,48 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// gate holds uploads for a remote while the server has told us to back off or
+// rejected our credentials. Files waiting on a closed gate keep their error
+// budget, since the failure is not theirs.
+type gate struct {
+	mu     sync.Mutex
+	until  time.Time
+	reason string
+}
+
+// pause closes the gate for d, unless it is already closed for longer.
+func (g *gate) pause(d time.Duration, reason string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if until := time.Now().Add(d); until.After(g.until) {
+		g.until = until
+		g.reason = reason
+	}
+}
+
+// status returns how long the gate stays closed and why.
+func (g *gate) status() (time.Duration, string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return time.Until(g.until), g.reason
+}
+
+// wait blocks until the gate opens. It returns false if ctx ends first.
+func (g *gate) wait(ctx context.Context) bool {
+	for {
+		remaining, _ := g.status()
+		if remaining <= 0 {
+			return true
+		}
+		select {
+		case <-time.After(remaining):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/api"
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/cleverdata/sift-agent/internal/db"
+	"github.com/cleverdata/sift-agent/internal/metrics"
+)
+
+// health is the live state of one remote's pipeline, reported in heartbeats.
+type health struct {
+	mu          sync.Mutex
+	name        string
+	mode        string
+	pending     int // Files settling
+	active      int // Files dispatched to the worker pool
+	inFlight    int // Files holding a worker slot
+	lastUpload  time.Time
+	lastError   string
+	lastErrorAt time.Time
+}
+
+var (
+	healthMu       sync.Mutex
+	healthByRemote = make(map[string]*health)
+)
+
+func healthFor(remote string) *health {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	h, ok := healthByRemote[remote]
+	if !ok {
+		h = &health{name: remote, mode: "fsnotify"}
+		h.publishLocked()
+		healthByRemote[remote] = h
+	}
+	return h
+}
+
+func (h *health) setMode(mode string) {
+	h.mu.Lock()
+	h.mode = mode
+	h.mu.Unlock()
+}
+
+func (h *health) setQueue(pending, active int) {
+	h.mu.Lock()
+	h.pending, h.active = pending, active
+	h.publishLocked()
+	h.mu.Unlock()
+}
+
+func (h *health) addInFlight(n int) {
+	h.mu.Lock()
+	h.inFlight += n
+	h.publishLocked()
+	h.mu.Unlock()
+}
+
+// publishLocked updates the queue gauges. h.mu must be held.
+func (h *health) publishLocked() {
+	metrics.QueueDepth.Set(float64(h.pending+h.active-h.inFlight), h.name)
+	metrics.InFlight.Set(float64(h.inFlight), h.name)
+}
+
+func (h *health) uploaded() {
+	h.mu.Lock()
+	h.lastUpload = time.Now()
+	h.mu.Unlock()
+}
+
+func (h *health) failed(err error) {
+	h.mu.Lock()
+	h.lastError = err.Error()
+	h.lastErrorAt = time.Now()
+	h.mu.Unlock()
+}
+
+// Health returns the heartbeat status of a remote. Version and hostname are
+// left for the caller.
+func Health(remote config.RemoteConfig) api.Heartbeat {
+	h := healthFor(remote.Name)
+	h.mu.Lock()
+	hb := api.Heartbeat{
+		Remote:     remote.Name,
+		Mode:       h.mode,
+		QueueDepth: h.pending + h.active - h.inFlight,
+		InFlight:   h.inFlight,
+		LastError:  h.lastError,
+	}
+	if !h.lastUpload.IsZero() {
+		t := h.lastUpload.UTC()
+		hb.LastUpload = &t
+	}
+	if !h.lastErrorAt.IsZero() {
+		t := h.lastErrorAt.UTC()
+		hb.LastErrorAt = &t
+	}
+	h.mu.Unlock()
+
+	if dir, err := filepath.Abs(remote.Path); err == nil {
+		hb.FailedFiles = db.CountFailed(dir)
+	}
+	return hb
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/api"
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/cleverdata/sift-agent/internal/db"
+	"github.com/cleverdata/sift-agent/internal/metrics"
+)
+
+// sample returns the value of one exposed sample, e.g.
+// sift_heartbeat_up{remote="office"}.
+func sample(t *testing.T, series string) float64 {
+	t.Helper()
+	for _, line := range strings.Split(metrics.Text(), "\n") {
+		if v, ok := strings.CutPrefix(line, series+" "); ok {
+			f, _ := strconv.ParseFloat(v, 64)
+			return f
+		}
+	}
+	return 0
+}
+
+func TestHeartbeatReportsHealth(t *testing.T) {
+	initDB(t)
+	watched := t.TempDir()
+	remote := config.RemoteConfig{Name: "heartbeat-" + filepath.Base(watched), Path: watched, Key: "k", HeartbeatInterval: "20ms"}
+	db.MarkFailed(filepath.Join(watched, "broken.pdf"), "", 1, 10)
+	db.MarkFailed(filepath.Join(watched+"-other", "elsewhere.pdf"), "", 1, 10)
+
+	h := healthFor(remote.Name)
+	h.setMode("polling")
+	h.setQueue(3, 2)
+	h.addInFlight(1)
+	h.uploaded()
+	h.failed(errors.New("upload rejected"))
+
+	var mu sync.Mutex
+	var reports []api.Heartbeat
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var hb api.Heartbeat
+		json.NewDecoder(r.Body).Decode(&hb)
+		mu.Lock()
+		reports = append(reports, hb)
+		n := len(reports)
+		mu.Unlock()
+		switch n {
+		case 1:
+			w.Write([]byte(`{"capabilities":[]}`))
+		case 2:
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			// Drop the connection without an answer
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		}
+	}))
+	defer srv.Close()
+	remote.Endpoint = srv.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	series := `{remote="` + remote.Name + `"}`
+	upOnOK := -1.0
+	status := func() api.Heartbeat {
+		hb := Health(remote)
+		hb.Version, hb.Hostname = "1.2.3", "scanner-01"
+		return hb
+	}
+	go api.Pinger(ctx, remote, status, nil, func() { upOnOK = sample(t, "sift_heartbeat_up"+series) }, nil)
+
+	failed := `sift_heartbeats_total{remote="` + remote.Name + `",result="failed"}`
+	deadline := time.Now().Add(5 * time.Second)
+	for sample(t, failed) < 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("no failed heartbeat recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	if upOnOK != 1 {
+		t.Fatalf("sift_heartbeat_up was %v after an accepted heartbeat", upOnOK)
+	}
+	if up := sample(t, "sift_heartbeat_up"+series); up != 0 {
+		t.Fatalf("sift_heartbeat_up is %v after a failed heartbeat", up)
+	}
+	for _, result := range []string{"ok", "rejected"} {
+		if n := sample(t, `sift_heartbeats_total{remote="`+remote.Name+`",result="`+result+`"}`); n != 1 {
+			t.Fatalf("%v %s heartbeats counted, want 1", n, result)
+		}
+	}
+
+	mu.Lock()
+	hb := reports[0]
+	mu.Unlock()
+	if hb.Version != "1.2.3" || hb.Hostname != "scanner-01" || hb.Remote != remote.Name || hb.Mode != "polling" {
+		t.Fatalf("heartbeat identifies itself as %+v", hb)
+	}
+	if hb.QueueDepth != 4 || hb.InFlight != 1 || hb.FailedFiles != 1 {
+		t.Fatalf("queue_depth %d, in_flight %d, failed_files %d, want 4, 1 and 1", hb.QueueDepth, hb.InFlight, hb.FailedFiles)
+	}
+	if hb.LastUpload == nil || hb.LastErrorAt == nil || hb.LastError != "upload rejected" {
+		t.Fatalf("last upload %v, last error %q at %v", hb.LastUpload, hb.LastError, hb.LastErrorAt)
+	}
+}
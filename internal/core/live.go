@@ -0,0 +1,184 @@
+package core
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cleverdata/sift-agent/internal/api"
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/cleverdata/sift-agent/internal/db"
+)
+
+// liveConfig is a remote's effective configuration: the local config with the
+// persisted server overrides applied. The watcher reads it on every use, so
+// overrides take effect without a restart.
+type liveConfig struct {
+	mu    sync.RWMutex
+	base  config.RemoteConfig
+	cfg   config.RemoteConfig
+	slots *slots
+
+	refused map[string]string // Last refused value per field, to log each refusal once
+}
+
+var (
+	liveMu       sync.Mutex
+	liveByRemote = make(map[string]*liveConfig)
+)
+
+// liveFor returns the live config of a remote, loading its persisted overrides
+// on first use.
+func liveFor(remote config.RemoteConfig) *liveConfig {
+	liveMu.Lock()
+	defer liveMu.Unlock()
+	l, ok := liveByRemote[remote.Name]
+	if !ok {
+		l = &liveConfig{base: remote, refused: make(map[string]string)}
+		l.slots = newSlots(concurrencyLimit(remote))
+		l.rebuildLocked()
+		liveByRemote[remote.Name] = l
+	}
+	return l
+}
+
+func (l *liveConfig) get() config.RemoteConfig {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.cfg
+}
+
+// rebuildLocked recomputes the effective config from the base and the
+// persisted overrides. Overrides that are pinned or no longer valid are
+// skipped. l.mu must be held.
+func (l *liveConfig) rebuildLocked() {
+	cfg := l.base
+	for _, o := range db.GetOverrides(l.base.Name) {
+		if cfg.IsPinned(o.Field) {
+			continue
+		}
+		next := cfg
+		if config.ApplyOverride(&next, o.Field, o.Value) != nil {
+			continue
+		}
+		if _, err := api.UploaderFor(next); err != nil {
+			continue
+		}
+		cfg = next
+	}
+
+	l.cfg = cfg
+	l.slots.setLimit(concurrencyLimit(cfg))
+}
+
+// ApplyOverrides validates server-pushed settings for a remote, persists the
+// accepted ones with their source and applies them live. Pinned fields,
+// invalid values and values the remote cannot use are refused. Fields the server no longer sends revert to the
+// local config. It returns the new effective config.
+func ApplyOverrides(remote config.RemoteConfig, overrides map[string]string, source string, logger Logger) config.RemoteConfig {
+	l := liveFor(remote)
+
+	current := make(map[string]string)
+	for _, o := range db.GetOverrides(remote.Name) {
+		current[o.Field] = o.Value
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	refuse := func(field, value string, reason error) {
+		if prev, ok := l.refused[field]; ok && prev == value {
+			return
+		}
+		l.refused[field] = value
+		if logger != nil {
+			logger.Warningf("[%s] Refused server override %s=%s: %v", remote.Name, field, value, reason)
+		}
+	}
+
+	changed := false
+	for field, value := range overrides {
+		if prev, ok := current[field]; ok && prev == value {
+			continue
+		}
+		if l.base.IsPinned(field) {
+			refuse(field, value, errors.New("field is pinned locally"))
+			continue
+		}
+		probe := l.cfg
+		if err := config.ApplyOverride(&probe, field, value); err != nil {
+			refuse(field, value, err)
+			continue
+		}
+		// The remote as a whole must still be valid, e.g. dedup_policy
+		// reference only works against a Sift server.
+		if _, err := api.UploaderFor(probe); err != nil {
+			refuse(field, value, err)
+			continue
+		}
+
+		db.SaveOverride(db.Override{Remote: remote.Name, Field: field, Value: value, Source: source, AppliedAt: time.Now()})
+		changed = true
+		if logger != nil {
+			logger.Infof("[%s] Applied server override %s=%s (from %s).", remote.Name, field, value, source)
+		}
+	}
+
+	for field := range current {
+		if _, ok := overrides[field]; !ok {
+			db.DeleteOverride(remote.Name, field)
+			changed = true
+			if logger != nil {
+				logger.Infof("[%s] Server override for %s withdrawn. Reverting to local value.", remote.Name, field)
+			}
+		}
+	}
+
+	if changed {
+		l.rebuildLocked()
+	}
+	return l.cfg
+}
+
+func concurrencyLimit(remote config.RemoteConfig) int {
+	if remote.ConcurrencyLimit <= 0 {
+		return 5
+	}
+	return remote.ConcurrencyLimit
+}
+
+// slots is a worker pool limit that can change while workers hold slots.
+type slots struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int
+	used  int
+}
+
+func newSlots(limit int) *slots {
+	s := &slots{limit: limit}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *slots) acquire() {
+	s.mu.Lock()
+	for s.used >= s.limit {
+		s.cond.Wait()
+	}
+	s.used++
+	s.mu.Unlock()
+}
+
+func (s *slots) release() {
+	s.mu.Lock()
+	s.used--
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+func (s *slots) setLimit(limit int) {
+	s.mu.Lock()
+	s.limit = limit
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
@@ -0,0 +1,37 @@
+package core
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/cleverdata/sift-agent/internal/config"
+	"github.com/cleverdata/sift-agent/internal/db"
+)
+
+func initDB(t *testing.T) {
+	t.Helper()
+	if err := db.Init(filepath.Join(t.TempDir(), "state.db")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOverridesTheRemoteCannotUseAreRefused(t *testing.T) {
+	initDB(t)
+	remote := config.RemoteConfig{Name: "archive-dir", Type: config.TypeDir, Endpoint: t.TempDir(), DedupPolicy: config.DedupSkip}
+
+	cfg := ApplyOverrides(remote, map[string]string{
+		"dedup_policy":    config.DedupReference, // Needs a Sift server
+		"chunk_size":      "1GiB",
+		"chunk_threshold": "128MiB",
+	}, "test", nil)
+
+	if cfg.DedupPolicy != config.DedupSkip || cfg.ChunkSize != "" {
+		t.Fatalf("refused overrides applied: dedup_policy=%s chunk_size=%s", cfg.DedupPolicy, cfg.ChunkSize)
+	}
+	if cfg.ChunkThreshold != "128MiB" {
+		t.Fatalf("valid override not applied, chunk_threshold=%q", cfg.ChunkThreshold)
+	}
+	if n := len(db.GetOverrides(remote.Name)); n != 1 {
+		t.Fatalf("%d overrides persisted, want 1", n)
+	}
+}
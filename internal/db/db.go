@@ -6,17 +6,21 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/cleverdata/sift-agent/internal/metrics"
+
 	_ "modernc.org/sqlite"
 )
 
 const (
-	StatusPending  = "PENDING"
-	StatusUploaded = "UPLOADED"
-	StatusVerified = "VERIFIED"
-	StatusCorrupt  = "CORRUPT"
-	StatusFailed   = "FAILED"
+	StatusPending   = "PENDING"
+	StatusUploaded  = "UPLOADED"
+	StatusVerified  = "VERIFIED"
+	StatusCorrupt   = "CORRUPT"
+	StatusFailed    = "FAILED"
+	StatusDuplicate = "DUPLICATE"
 )
 
 var dbInstance *sql.DB
@@ -31,6 +35,9 @@ func Init(dbPath string) error {
 	if err != nil {
 		return fmt.Errorf("failed to open database at %s: %w", dbPath, err)
 	}
+	// Upload workers write concurrently. A single connection serializes them
+	// instead of failing with SQLITE_BUSY.
+	dbInstance.SetMaxOpenConns(1)
 
 	// Create Table
 	schema := `
@@ -44,15 +51,100 @@ func Init(dbPath string) error {
 		tenant_id TEXT,
 		error_count INTEGER DEFAULT 0
 	);
+	CREATE TABLE IF NOT EXISTS upload_sessions (
+		file_path TEXT PRIMARY KEY,
+		endpoint TEXT,
+		session_id TEXT,
+		file_hash TEXT,
+		file_size INTEGER,
+		mod_time INTEGER,
+		chunk_size INTEGER,
+		offset INTEGER DEFAULT 0,
+		updated_at DATETIME
+	);
+	CREATE TABLE IF NOT EXISTS destination_log (
+		file_path TEXT,
+		destination TEXT,
+		remote TEXT,
+		file_hash TEXT,
+		mod_time INTEGER,
+		status TEXT,
+		remote_id TEXT,
+		error_count INTEGER DEFAULT 0,
+		last_attempt_at DATETIME,
+		next_attempt_at INTEGER,
+		PRIMARY KEY (file_path, destination)
+	);
+	CREATE TABLE IF NOT EXISTS config_overrides (
+		remote TEXT,
+		field TEXT,
+		value TEXT,
+		source TEXT,
+		applied_at DATETIME,
+		PRIMARY KEY (remote, field)
+	);
 	`
 	if _, err := dbInstance.Exec(schema); err != nil {
 		return fmt.Errorf("failed to initialize schema: %w", err)
 	}
+
+	// Columns added after the initial release. Existing databases are upgraded in place.
+	migrations := []struct{ table, column, decl string }{
+		{"file_log", "endpoint", "TEXT"},
+		{"file_log", "duplicate_of", "TEXT"},
+		{"file_log", "remote_id", "TEXT"},
+		{"file_log", "remote", "TEXT"},
+		{"file_log", "next_attempt_at", "INTEGER"}, // Unix seconds, NULL when nothing is scheduled
+	}
+	for _, m := range migrations {
+		if err := addColumn(m.table, m.column, m.decl); err != nil {
+			return fmt.Errorf("failed to migrate schema: %w", err)
+		}
+	}
+
+	if _, err := dbInstance.Exec("CREATE INDEX IF NOT EXISTS idx_file_log_hash ON file_log(file_hash)"); err != nil {
+		return fmt.Errorf("failed to create hash index: %w", err)
+	}
+	if _, err := dbInstance.Exec("CREATE INDEX IF NOT EXISTS idx_file_log_next_attempt ON file_log(next_attempt_at)"); err != nil {
+		return fmt.Errorf("failed to create schedule index: %w", err)
+	}
 	return nil
 }
 
+// logError logs a failed database operation and counts it.
+func logError(format string, err error) {
+	metrics.DBErrors.Inc()
+	log.Printf(format, err)
+}
+
+func addColumn(table, column, decl string) error {
+	rows, err := dbInstance.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = dbInstance.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl))
+	return err
+}
+
 func GetFileRecord(path string) (string, int64, string, int) {
-	row := dbInstance.QueryRow("SELECT status, mod_time, file_hash, error_count FROM file_log WHERE file_path = ?", path)
+	row := dbInstance.QueryRow("SELECT COALESCE(status, ''), COALESCE(mod_time, 0), COALESCE(file_hash, ''), error_count FROM file_log WHERE file_path = ?", path)
 	var status, hash string
 	var modTime int64
 	var errCount int
@@ -60,41 +152,434 @@ func GetFileRecord(path string) (string, int64, string, int) {
 		if err == sql.ErrNoRows {
 			return "", 0, "", 0
 		}
-		log.Printf("DB Read Error: %v", err)
+		logError("DB Read Error: %v", err)
 		return "", 0, "", 0
 	}
 	return status, modTime, hash, errCount
 }
 
-func UpdateFileStatus(path string, status string, hash string, modTime int64, size int64) {
+func UpdateFileStatus(path string, endpoint string, status string, hash string, modTime int64, size int64) {
+	_, err := dbInstance.Exec(`
+		INSERT INTO file_log (file_path, endpoint, file_hash, mod_time, file_size, status, last_attempt_at, error_count, duplicate_of)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 0, NULL)
+		ON CONFLICT(file_path) DO UPDATE SET
+			endpoint = excluded.endpoint,
+			status = excluded.status,
+			file_hash = excluded.file_hash,
+			mod_time = excluded.mod_time,
+			file_size = excluded.file_size,
+			last_attempt_at = excluded.last_attempt_at,
+			error_count = 0,
+			duplicate_of = NULL,
+			next_attempt_at = NULL
+	`, path, endpoint, hash, modTime, size, status, time.Now())
+
+	if err != nil {
+		logError("DB Write Error: %v", err)
+	}
+}
+
+// FindByHash returns the path of a previously uploaded file with the given
+// content hash on the same endpoint, ignoring the record for excludePath.
+func FindByHash(hash string, endpoint string, excludePath string) (string, bool) {
+	row := dbInstance.QueryRow(`
+		SELECT file_path FROM file_log
+		WHERE file_hash = ? AND endpoint = ? AND file_path != ? AND status IN (?, ?)
+		ORDER BY last_attempt_at ASC
+		LIMIT 1
+	`, hash, endpoint, excludePath, StatusUploaded, StatusVerified)
+
+	var original string
+	if err := row.Scan(&original); err != nil {
+		if err != sql.ErrNoRows {
+			logError("DB Hash Lookup Error: %v", err)
+		}
+		return "", false
+	}
+	return original, true
+}
+
+func MarkDuplicate(path string, endpoint string, hash string, modTime int64, size int64, originalPath string) {
+	_, err := dbInstance.Exec(`
+		INSERT INTO file_log (file_path, endpoint, file_hash, mod_time, file_size, status, last_attempt_at, error_count, duplicate_of)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 0, ?)
+		ON CONFLICT(file_path) DO UPDATE SET
+			endpoint = excluded.endpoint,
+			status = excluded.status,
+			file_hash = excluded.file_hash,
+			mod_time = excluded.mod_time,
+			file_size = excluded.file_size,
+			last_attempt_at = excluded.last_attempt_at,
+			error_count = 0,
+			duplicate_of = excluded.duplicate_of,
+			next_attempt_at = NULL
+	`, path, endpoint, hash, modTime, size, StatusDuplicate, time.Now(), originalPath)
+
+	if err != nil {
+		logError("DB Mark Duplicate Failed: %v", err)
+	}
+}
+
+// MarkUploaded records a transfer the server accepted but has not yet
+// confirmed, along with the document ID used to verify it later. The error
+// count is kept so repeated CORRUPT verifications still reach the cutoff.
+func MarkUploaded(path string, endpoint string, hash string, modTime int64, size int64, remoteID string) {
 	_, err := dbInstance.Exec(`
-		INSERT INTO file_log (file_path, file_hash, mod_time, file_size, status, last_attempt_at, error_count)
-		VALUES (?, ?, ?, ?, ?, ?, 0)
+		INSERT INTO file_log (file_path, endpoint, file_hash, mod_time, file_size, status, last_attempt_at, error_count, remote_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 0, ?)
 		ON CONFLICT(file_path) DO UPDATE SET
+			endpoint = excluded.endpoint,
 			status = excluded.status,
 			file_hash = excluded.file_hash,
 			mod_time = excluded.mod_time,
 			file_size = excluded.file_size,
 			last_attempt_at = excluded.last_attempt_at,
-			error_count = 0
-	`, path, hash, modTime, size, status, time.Now())
+			remote_id = excluded.remote_id,
+			duplicate_of = NULL,
+			next_attempt_at = NULL
+	`, path, endpoint, hash, modTime, size, StatusUploaded, time.Now(), remoteID)
 
 	if err != nil {
-		log.Printf("DB Write Error: %v", err)
+		logError("DB Write Error: %v", err)
 	}
 }
 
-func IncrementError(path string) {
-	_, err := dbInstance.Exec("UPDATE file_log SET error_count = error_count + 1, last_attempt_at = ? WHERE file_path = ?", time.Now(), path)
+func MarkVerified(path string) {
+	_, err := dbInstance.Exec("UPDATE file_log SET status = ?, last_attempt_at = ?, error_count = 0, next_attempt_at = NULL WHERE file_path = ?", StatusVerified, time.Now(), path)
 	if err != nil {
-		log.Printf("DB Error Increment Failed: %v", err)
+		logError("DB Mark Verified Failed: %v", err)
+	}
+}
+
+// GetUploadRecord returns the server document ID and the size recorded for an
+// uploaded file.
+func GetUploadRecord(path string) (string, int64) {
+	row := dbInstance.QueryRow("SELECT COALESCE(remote_id, ''), COALESCE(file_size, 0) FROM file_log WHERE file_path = ?", path)
+	var remoteID string
+	var size int64
+	if err := row.Scan(&remoteID, &size); err != nil {
+		if err != sql.ErrNoRows {
+			logError("DB Read Error: %v", err)
+		}
+		return "", 0
+	}
+	return remoteID, size
+}
+
+// IncrementError charges a failed attempt to the file, creating its record if
+// this is the first one, and returns the new error count. A changed mod time
+// means new content, so any earlier status no longer applies and the count
+// starts over.
+func IncrementError(path string, remote string, modTime int64) int {
+	row := dbInstance.QueryRow(`
+		INSERT INTO file_log (file_path, remote, mod_time, status, last_attempt_at, error_count)
+		VALUES (?, ?, ?, ?, ?, 1)
+		ON CONFLICT(file_path) DO UPDATE SET
+			remote = excluded.remote,
+			status = CASE WHEN file_log.mod_time IS excluded.mod_time THEN file_log.status ELSE excluded.status END,
+			mod_time = excluded.mod_time,
+			last_attempt_at = excluded.last_attempt_at,
+			error_count = CASE WHEN file_log.mod_time IS excluded.mod_time THEN error_count + 1 ELSE 1 END
+		RETURNING error_count
+	`, path, remote, modTime, StatusPending, time.Now())
+
+	var count int
+	if err := row.Scan(&count); err != nil {
+		logError("DB Error Increment Failed: %v", err)
+	}
+	return count
+}
+
+// ScheduleRetry sets when the file should next be attempted.
+func ScheduleRetry(path string, remote string, modTime int64, at time.Time) {
+	_, err := dbInstance.Exec(`
+		INSERT INTO file_log (file_path, remote, mod_time, status, error_count, next_attempt_at)
+		VALUES (?, ?, ?, ?, 0, ?)
+		ON CONFLICT(file_path) DO UPDATE SET
+			remote = excluded.remote,
+			status = CASE WHEN file_log.mod_time IS excluded.mod_time THEN file_log.status ELSE excluded.status END,
+			mod_time = excluded.mod_time,
+			next_attempt_at = excluded.next_attempt_at
+	`, path, remote, modTime, StatusPending, at.Unix())
+
+	if err != nil {
+		logError("DB Schedule Retry Failed: %v", err)
+	}
+}
+
+func ClearRetry(path string) {
+	_, err := dbInstance.Exec("UPDATE file_log SET next_attempt_at = NULL WHERE file_path = ?", path)
+	if err != nil {
+		logError("DB Clear Retry Failed: %v", err)
+	}
+}
+
+// NextAttempt returns when the file is scheduled to be retried, if at all.
+func NextAttempt(path string) (time.Time, bool) {
+	row := dbInstance.QueryRow("SELECT next_attempt_at FROM file_log WHERE file_path = ?", path)
+	var at sql.NullInt64
+	if err := row.Scan(&at); err != nil || !at.Valid {
+		return time.Time{}, false
+	}
+	return time.Unix(at.Int64, 0), true
+}
+
+// DueRetries returns the files of a remote whose scheduled retry time has passed.
+func DueRetries(remote string, now time.Time) []string {
+	rows, err := dbInstance.Query("SELECT file_path FROM file_log WHERE remote = ? AND next_attempt_at <= ? ORDER BY next_attempt_at", remote, now.Unix())
+	if err != nil {
+		logError("DB Read Error: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err == nil {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// DestinationStatus returns the delivery status of the file's current content
+// to one of a remote's additional destinations, or "" if it was never
+// attempted.
+func DestinationStatus(path string, destination string, modTime int64) string {
+	row := dbInstance.QueryRow("SELECT COALESCE(status, '') FROM destination_log WHERE file_path = ? AND destination = ? AND mod_time = ?", path, destination, modTime)
+	var status string
+	if err := row.Scan(&status); err != nil {
+		if err != sql.ErrNoRows {
+			logError("DB Read Error: %v", err)
+		}
+		return ""
+	}
+	return status
+}
+
+// MarkDelivered records a successful delivery to an additional destination.
+func MarkDelivered(path string, destination string, remote string, modTime int64, hash string, remoteID string) {
+	_, err := dbInstance.Exec(`
+		INSERT INTO destination_log (file_path, destination, remote, file_hash, mod_time, status, remote_id, error_count, last_attempt_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 0, ?)
+		ON CONFLICT(file_path, destination) DO UPDATE SET
+			remote = excluded.remote,
+			file_hash = excluded.file_hash,
+			mod_time = excluded.mod_time,
+			status = excluded.status,
+			remote_id = excluded.remote_id,
+			error_count = 0,
+			last_attempt_at = excluded.last_attempt_at,
+			next_attempt_at = NULL
+	`, path, destination, remote, hash, modTime, StatusUploaded, remoteID, time.Now())
+
+	if err != nil {
+		logError("DB Write Error: %v", err)
+	}
+}
+
+// DestinationFailed charges a failed delivery to the destination with the
+// given status and returns the new error count. Changed content starts a new
+// count.
+func DestinationFailed(path string, destination string, remote string, modTime int64, status string) int {
+	row := dbInstance.QueryRow(`
+		INSERT INTO destination_log (file_path, destination, remote, mod_time, status, error_count, last_attempt_at)
+		VALUES (?, ?, ?, ?, ?, 1, ?)
+		ON CONFLICT(file_path, destination) DO UPDATE SET
+			remote = excluded.remote,
+			error_count = CASE WHEN destination_log.mod_time IS excluded.mod_time THEN error_count + 1 ELSE 1 END,
+			mod_time = excluded.mod_time,
+			status = excluded.status,
+			last_attempt_at = excluded.last_attempt_at,
+			next_attempt_at = NULL
+		RETURNING error_count
+	`, path, destination, remote, modTime, status, time.Now())
+
+	var count int
+	if err := row.Scan(&count); err != nil {
+		logError("DB Destination Failure Failed: %v", err)
+	}
+	return count
+}
+
+// ScheduleDestination sets when delivery to the destination should next be
+// attempted. A zero time clears the schedule.
+func ScheduleDestination(path string, destination string, remote string, modTime int64, at time.Time) {
+	var next interface{}
+	if !at.IsZero() {
+		next = at.Unix()
+	}
+	_, err := dbInstance.Exec(`
+		INSERT INTO destination_log (file_path, destination, remote, mod_time, status, error_count, next_attempt_at)
+		VALUES (?, ?, ?, ?, ?, 0, ?)
+		ON CONFLICT(file_path, destination) DO UPDATE SET
+			remote = excluded.remote,
+			status = CASE WHEN destination_log.mod_time IS excluded.mod_time THEN destination_log.status ELSE excluded.status END,
+			mod_time = excluded.mod_time,
+			next_attempt_at = excluded.next_attempt_at
+	`, path, destination, remote, modTime, StatusPending, next)
+
+	if err != nil {
+		logError("DB Schedule Retry Failed: %v", err)
+	}
+}
+
+// DueDelivery is a scheduled delivery to an additional destination.
+type DueDelivery struct {
+	Path        string
+	Destination string
+	ModTime     int64
+}
+
+// DueDeliveries returns the deliveries of a remote whose scheduled retry time
+// has passed.
+func DueDeliveries(remote string, now time.Time) []DueDelivery {
+	rows, err := dbInstance.Query("SELECT file_path, destination, COALESCE(mod_time, 0) FROM destination_log WHERE remote = ? AND next_attempt_at <= ? ORDER BY next_attempt_at", remote, now.Unix())
+	if err != nil {
+		logError("DB Read Error: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var due []DueDelivery
+	for rows.Next() {
+		var d DueDelivery
+		if err := rows.Scan(&d.Path, &d.Destination, &d.ModTime); err == nil {
+			due = append(due, d)
+		}
+	}
+	return due
+}
+
+// MoveDestinations follows a file to its new location, so deliveries still
+// outstanding are retried from there.
+func MoveDestinations(oldPath string, newPath string) {
+	_, err := dbInstance.Exec("UPDATE destination_log SET file_path = ? WHERE file_path = ?", newPath, oldPath)
+	if err != nil {
+		logError("DB Move Destinations Failed: %v", err)
+	}
+}
+
+// ScheduledRetry is one entry of the upcoming retry schedule.
+type ScheduledRetry struct {
+	Path        string
+	Remote      string
+	Status      string
+	ErrorCount  int
+	NextAttempt time.Time
+}
+
+// ListRetries returns every scheduled retry, soonest first. Deliveries to
+// additional destinations are listed under the destination's name.
+func ListRetries() []ScheduledRetry {
+	rows, err := dbInstance.Query(`
+		SELECT file_path, COALESCE(remote, ''), COALESCE(status, ''), error_count, next_attempt_at
+		FROM file_log WHERE next_attempt_at IS NOT NULL
+		UNION ALL
+		SELECT file_path, destination, COALESCE(status, ''), error_count, next_attempt_at
+		FROM destination_log WHERE next_attempt_at IS NOT NULL
+		ORDER BY next_attempt_at
+	`)
+	if err != nil {
+		logError("DB Read Error: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var list []ScheduledRetry
+	for rows.Next() {
+		var r ScheduledRetry
+		var at int64
+		if err := rows.Scan(&r.Path, &r.Remote, &r.Status, &r.ErrorCount, &at); err != nil {
+			logError("DB Read Error: %v", err)
+			continue
+		}
+		r.NextAttempt = time.Unix(at, 0)
+		list = append(list, r)
+	}
+	return list
+}
+
+// MarkFailed records a file the server rejected permanently.
+func MarkFailed(path string, endpoint string, modTime int64, size int64) {
+	_, err := dbInstance.Exec(`
+		INSERT INTO file_log (file_path, endpoint, mod_time, file_size, status, last_attempt_at, error_count)
+		VALUES (?, ?, ?, ?, ?, ?, 1)
+		ON CONFLICT(file_path) DO UPDATE SET
+			endpoint = excluded.endpoint,
+			status = excluded.status,
+			mod_time = excluded.mod_time,
+			file_size = excluded.file_size,
+			last_attempt_at = excluded.last_attempt_at,
+			error_count = error_count + 1,
+			next_attempt_at = NULL
+	`, path, endpoint, modTime, size, StatusFailed, time.Now())
+
+	if err != nil {
+		logError("DB Mark Failed Error: %v", err)
 	}
 }
 
 func MarkCorrupt(path string) {
 	_, err := dbInstance.Exec("UPDATE file_log SET status = ?, last_attempt_at = ? WHERE file_path = ?", StatusCorrupt, time.Now(), path)
 	if err != nil {
-		log.Printf("DB Mark Corrupt Failed: %v", err)
+		logError("DB Mark Corrupt Failed: %v", err)
+	}
+}
+
+// UploadSession is the persisted state of a resumable upload.
+type UploadSession struct {
+	FilePath  string
+	Endpoint  string
+	SessionID string
+	Hash      string
+	Size      int64
+	ModTime   int64
+	ChunkSize int64
+	Offset    int64 // Bytes acknowledged by the server
+}
+
+func GetUploadSession(path string) (UploadSession, bool) {
+	row := dbInstance.QueryRow(`
+		SELECT file_path, endpoint, session_id, file_hash, file_size, mod_time, chunk_size, offset
+		FROM upload_sessions WHERE file_path = ?
+	`, path)
+
+	var s UploadSession
+	if err := row.Scan(&s.FilePath, &s.Endpoint, &s.SessionID, &s.Hash, &s.Size, &s.ModTime, &s.ChunkSize, &s.Offset); err != nil {
+		if err != sql.ErrNoRows {
+			logError("DB Read Error: %v", err)
+		}
+		return UploadSession{}, false
+	}
+	return s, true
+}
+
+func SaveUploadSession(s UploadSession) {
+	_, err := dbInstance.Exec(`
+		INSERT INTO upload_sessions (file_path, endpoint, session_id, file_hash, file_size, mod_time, chunk_size, offset, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(file_path) DO UPDATE SET
+			endpoint = excluded.endpoint,
+			session_id = excluded.session_id,
+			file_hash = excluded.file_hash,
+			file_size = excluded.file_size,
+			mod_time = excluded.mod_time,
+			chunk_size = excluded.chunk_size,
+			offset = excluded.offset,
+			updated_at = excluded.updated_at
+	`, s.FilePath, s.Endpoint, s.SessionID, s.Hash, s.Size, s.ModTime, s.ChunkSize, s.Offset, time.Now())
+
+	if err != nil {
+		logError("DB Save Session Failed: %v", err)
+	}
+}
+
+func DeleteUploadSession(path string) {
+	_, err := dbInstance.Exec("DELETE FROM upload_sessions WHERE file_path = ?", path)
+	if err != nil {
+		logError("DB Delete Session Failed: %v", err)
 	}
 }
 
@@ -102,13 +587,98 @@ func ResetHistory(targetPath string) {
 	var err error
 	if targetPath != "" {
 		_, err = dbInstance.Exec("DELETE FROM file_log WHERE file_path = ?", targetPath)
+		if err == nil {
+			_, err = dbInstance.Exec("DELETE FROM upload_sessions WHERE file_path = ?", targetPath)
+		}
+		if err == nil {
+			_, err = dbInstance.Exec("DELETE FROM destination_log WHERE file_path = ?", targetPath)
+		}
 	} else {
 		_, err = dbInstance.Exec("DELETE FROM file_log")
+		if err == nil {
+			_, err = dbInstance.Exec("DELETE FROM upload_sessions")
+		}
+		if err == nil {
+			_, err = dbInstance.Exec("DELETE FROM destination_log")
+		}
 	}
 
 	if err != nil {
-		log.Printf("Failed to reset history: %v", err)
+		logError("Failed to reset history: %v", err)
 	} else {
 		log.Println("History reset successfully.")
 	}
 }
+
+// CountFailed returns how many files under dir were rejected, failed
+// verification or are still failing.
+func CountFailed(dir string) int {
+	prefix := strings.TrimSuffix(dir, string(filepath.Separator)) + string(filepath.Separator)
+	row := dbInstance.QueryRow(`
+		SELECT COUNT(*) FROM file_log
+		WHERE substr(CAST(file_path AS BLOB), 1, ?) = CAST(? AS BLOB)
+		AND (status IN (?, ?) OR (error_count > 0 AND status NOT IN (?, ?)))
+	`, len(prefix), prefix, StatusFailed, StatusCorrupt, StatusVerified, StatusDuplicate)
+
+	var count int
+	if err := row.Scan(&count); err != nil {
+		logError("DB Read Error: %v", err)
+	}
+	return count
+}
+
+// Override is a server-pushed setting for a remote, with where it came from.
+type Override struct {
+	Remote    string
+	Field     string
+	Value     string
+	Source    string
+	AppliedAt time.Time
+}
+
+// GetOverrides returns the persisted overrides, for one remote or all if remote
+// is empty.
+func GetOverrides(remote string) []Override {
+	rows, err := dbInstance.Query(`
+		SELECT remote, field, value, COALESCE(source, ''), applied_at
+		FROM config_overrides WHERE ? = '' OR remote = ? ORDER BY remote, field
+	`, remote, remote)
+	if err != nil {
+		logError("DB Read Error: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var list []Override
+	for rows.Next() {
+		var o Override
+		if err := rows.Scan(&o.Remote, &o.Field, &o.Value, &o.Source, &o.AppliedAt); err != nil {
+			logError("DB Read Error: %v", err)
+			continue
+		}
+		list = append(list, o)
+	}
+	return list
+}
+
+func SaveOverride(o Override) {
+	_, err := dbInstance.Exec(`
+		INSERT INTO config_overrides (remote, field, value, source, applied_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(remote, field) DO UPDATE SET
+			value = excluded.value,
+			source = excluded.source,
+			applied_at = excluded.applied_at
+	`, o.Remote, o.Field, o.Value, o.Source, o.AppliedAt)
+
+	if err != nil {
+		logError("DB Save Override Failed: %v", err)
+	}
+}
+
+func DeleteOverride(remote string, field string) {
+	_, err := dbInstance.Exec("DELETE FROM config_overrides WHERE remote = ? AND field = ?", remote, field)
+	if err != nil {
+		logError("DB Delete Override Failed: %v", err)
+	}
+}
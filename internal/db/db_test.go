@@ -0,0 +1,60 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func initTest(t *testing.T) {
+	t.Helper()
+	if err := Init(filepath.Join(t.TempDir(), "state.db")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIncrementErrorStartsOverOnNewContent(t *testing.T) {
+	initTest(t)
+	for want := 1; want <= 3; want++ {
+		if n := IncrementError("/data/scan.pdf", "office", 100); n != want {
+			t.Fatalf("attempt %d counted as %d", want, n)
+		}
+	}
+	if n := IncrementError("/data/scan.pdf", "office", 200); n != 1 {
+		t.Fatalf("first failure of new content counted as %d", n)
+	}
+	if n := IncrementError("/data/scan.pdf", "office", 200); n != 2 {
+		t.Fatalf("second failure of new content counted as %d", n)
+	}
+}
+
+func TestScheduledRetrySurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	if err := Init(path); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+	ScheduleRetry("/data/scan.pdf", "office", 100, at)
+
+	if due := DueRetries("office", time.Now()); len(due) != 0 {
+		t.Fatalf("retry due before its time: %v", due)
+	}
+	dbInstance.Close()
+	if err := Init(path); err != nil {
+		t.Fatal(err)
+	}
+	if next, ok := NextAttempt("/data/scan.pdf"); !ok || !next.Equal(at) {
+		t.Fatalf("after a restart the retry is scheduled at %v (%v), want %v", next, ok, at)
+	}
+	if due := DueRetries("office", at); len(due) != 1 || due[0] != "/data/scan.pdf" {
+		t.Fatalf("retry not due at its time: %v", due)
+	}
+	if due := DueRetries("branch", at); len(due) != 0 {
+		t.Fatalf("retry due for another remote: %v", due)
+	}
+
+	ClearRetry("/data/scan.pdf")
+	if _, ok := NextAttempt("/data/scan.pdf"); ok {
+		t.Fatal("cleared retry still scheduled")
+	}
+}
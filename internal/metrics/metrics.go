@@ -0,0 +1,181 @@
+// Package metrics holds the agent's in-process counters. Every metric the
+// agent records is declared here so the full set is visible in one place.
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	CompressionInputBytes = NewCounter("sift_compression_input_bytes_total",
+		"Bytes fed into request compression, before encoding.", "remote", "encoding")
+	CompressionOutputBytes = NewCounter("sift_compression_output_bytes_total",
+		"Bytes sent on the wire after request compression.", "remote", "encoding")
+
+	FilesDiscovered = NewCounter("sift_files_discovered_total",
+		"Files picked up for processing, by how they were found (fsnotify, poll or retry).", "remote", "source")
+	FilesSettled = NewCounter("sift_files_settled_total",
+		"Files that passed the stability checks.", "remote")
+	FilesUploaded = NewCounter("sift_files_uploaded_total",
+		"Files accepted by the remote's endpoint.", "remote")
+	FilesFailed = NewCounter("sift_files_failed_total",
+		"Failed uploads, by error class, or corrupt when verification failed.", "remote", "class")
+	FilesQuarantined = NewCounter("sift_files_quarantined_total",
+		"Files moved to .quarantine.", "remote")
+
+	QueueDepth = NewGauge("sift_queue_depth",
+		"Files settling or waiting for a worker slot.", "remote")
+	InFlight = NewGauge("sift_uploads_in_flight",
+		"Files holding a worker slot.", "remote")
+
+	UploadBytes = NewHistogram("sift_upload_bytes",
+		"Size of uploaded files.", ExponentialBuckets(1024, 4, 11), "remote")
+	UploadDuration = NewHistogram("sift_upload_duration_seconds",
+		"Time spent uploading a file, retries included, by result.", ExponentialBuckets(0.05, 2, 14), "remote", "result")
+	StabilityDuration = NewHistogram("sift_stability_duration_seconds",
+		"Time from the start of the stability checks until a file settled.", ExponentialBuckets(1, 2, 12), "remote")
+
+	HeartbeatUp = NewGauge("sift_heartbeat_up",
+		"1 if the last heartbeat was accepted by the server, 0 otherwise.", "remote")
+	Heartbeats = NewCounter("sift_heartbeats_total",
+		"Heartbeats sent, by result (ok, rejected or failed).", "remote", "result")
+	HeartbeatLastSuccess = NewGauge("sift_heartbeat_last_success_timestamp_seconds",
+		"Unix time of the last accepted heartbeat.", "remote")
+
+	DBErrors = NewCounter("sift_db_errors_total",
+		"Failed state database operations.")
+)
+
+// metric is a registered metric family.
+type metric interface {
+	write(b *strings.Builder)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	registry = append(registry, m)
+	registryMu.Unlock()
+}
+
+// Counter is a monotonically increasing value, partitioned by label values.
+type Counter struct {
+	Name   string
+	Help   string
+	Labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{Name: name, Help: help, Labels: labels, values: make(map[string]float64)}
+	if len(labels) == 0 {
+		c.values[""] = 0 // Reported from the start
+	}
+	register(c)
+	return c
+}
+
+// Add increases the counter for the given label values, which must be passed
+// in the order the labels were declared.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := labelKey(c.Name, c.Labels, labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Gauge is a value that goes up and down, partitioned by label values.
+type Gauge struct {
+	Name   string
+	Help   string
+	Labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	g := &Gauge{Name: name, Help: help, Labels: labels, values: make(map[string]float64)}
+	register(g)
+	return g
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	key := labelKey(g.Name, g.Labels, labelValues)
+	g.mu.Lock()
+	g.values[key] = v
+	g.mu.Unlock()
+}
+
+// Histogram counts observations into cumulative buckets, partitioned by label
+// values.
+type Histogram struct {
+	Name    string
+	Help    string
+	Labels  []string
+	Buckets []float64 // Upper bounds, ascending
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // Per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{Name: name, Help: help, Labels: labels, Buckets: buckets, series: make(map[string]*histogramSeries)}
+	register(h)
+	return h
+}
+
+// ExponentialBuckets returns count bucket bounds starting at start, each
+// factor times the previous one.
+func ExponentialBuckets(start float64, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := labelKey(h.Name, h.Labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.Buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.Buckets, v); i < len(h.Buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+// labelKey joins label values into a series key. A call with the wrong number
+// of values is a bug at the call site and panics, as in the Prometheus client.
+func labelKey(name string, labels []string, values []string) string {
+	if len(values) != len(labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", name, len(labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
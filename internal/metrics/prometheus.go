@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metrics are served in the Prometheus text format (version 0.0.4) on
+// /metrics of an optional local listener.
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Handler serves every registered metric.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write([]byte(Text()))
+	})
+}
+
+// Text renders every registered metric in the Prometheus text format.
+func Text() string {
+	registryMu.Lock()
+	metrics := append([]metric(nil), registry...)
+	registryMu.Unlock()
+
+	var b strings.Builder
+	for _, m := range metrics {
+		m.write(&b)
+	}
+	return b.String()
+}
+
+// Serve serves /metrics on ln until ctx ends.
+func Serve(ctx context.Context, ln net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (c *Counter) write(b *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(b, c.Name, c.Help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		writeSample(b, c.Name, c.Labels, key, "", "", c.values[key])
+	}
+}
+
+func (g *Gauge) write(b *strings.Builder) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	writeHeader(b, g.Name, g.Help, "gauge")
+	for _, key := range sortedKeys(g.values) {
+		writeSample(b, g.Name, g.Labels, key, "", "", g.values[key])
+	}
+}
+
+func (h *Histogram) write(b *strings.Builder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(b, h.Name, h.Help, "histogram")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.Buckets {
+			cumulative += s.counts[i]
+			writeSample(b, h.Name+"_bucket", h.Labels, key, "le", formatValue(bound), float64(cumulative))
+		}
+		writeSample(b, h.Name+"_bucket", h.Labels, key, "le", "+Inf", float64(s.count))
+		writeSample(b, h.Name+"_sum", h.Labels, key, "", "", s.sum)
+		writeSample(b, h.Name+"_count", h.Labels, key, "", "", float64(s.count))
+	}
+}
+
+func writeHeader(b *strings.Builder, name string, help string, kind string) {
+	b.WriteString("# HELP " + name + " " + strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help) + "\n")
+	b.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+// writeSample writes one sample line. key holds the label values joined as
+// stored, extraName and extraValue add a label such as a histogram's le.
+func writeSample(b *strings.Builder, name string, labels []string, key string, extraName string, extraValue string, v float64) {
+	b.WriteString(name)
+	var pairs []string
+	if len(labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			if i < len(labels) {
+				pairs = append(pairs, labels[i]+`="`+escapeLabel(value)+`"`)
+			}
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) > 0 {
+		b.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	b.WriteString(" " + formatValue(v) + "\n")
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
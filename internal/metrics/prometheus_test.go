@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func render(m metric) string {
+	var b strings.Builder
+	m.write(&b)
+	return b.String()
+}
+
+func TestExposition(t *testing.T) {
+	idle := NewCounter("test_idle_total", "Never incremented.")
+	if got, want := render(idle), `# HELP test_idle_total Never incremented.
+# TYPE test_idle_total counter
+test_idle_total 0
+`; got != want {
+		t.Errorf("unlabelled counter:\n%s\nwant\n%s", got, want)
+	}
+
+	files := &Counter{Name: "test_files_total", Help: "Files by path.\nOne line.", Labels: []string{"remote", "path"}, values: make(map[string]float64)}
+	files.Inc("office", `C:\scans\"q1"`)
+	files.Add(2.5, "branch", "line\nbreak")
+	if got, want := render(files), `# HELP test_files_total Files by path.\nOne line.
+# TYPE test_files_total counter
+test_files_total{remote="branch",path="line\nbreak"} 2.5
+test_files_total{remote="office",path="C:\\scans\\\"q1\""} 1
+`; got != want {
+		t.Errorf("label escaping:\n%s\nwant\n%s", got, want)
+	}
+
+	sizes := &Histogram{Name: "test_bytes", Help: "Sizes.", Labels: []string{"remote"}, Buckets: []float64{10, 100, 1000}, series: make(map[string]*histogramSeries)}
+	for _, v := range []float64{5, 10, 50, 500, 5000} {
+		sizes.Observe(v, "office")
+	}
+	if got, want := render(sizes), `# HELP test_bytes Sizes.
+# TYPE test_bytes histogram
+test_bytes_bucket{remote="office",le="10"} 2
+test_bytes_bucket{remote="office",le="100"} 3
+test_bytes_bucket{remote="office",le="1000"} 4
+test_bytes_bucket{remote="office",le="+Inf"} 5
+test_bytes_sum{remote="office"} 5565
+test_bytes_count{remote="office"} 5
+`; got != want {
+		t.Errorf("histogram:\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWrongLabelCountPanics(t *testing.T) {
+	c := &Counter{Name: "test_labels_total", Labels: []string{"remote", "result"}, values: make(map[string]float64)}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("counter accepted one value for two labels")
+		}
+	}()
+	c.Inc("office")
+}
@@ -0,0 +1,401 @@
+// Package update replaces the agent binary with a newer signed release.
+//
+// A release manifest lists one build per platform:
+//
+//	{
+//	  "version": "0.3.0",
+//	  "builds": {
+//	    "linux-amd64": {
+//	      "url": "sift-linux-amd64",
+//	      "sha256": "<hex digest of the binary>",
+//	      "signature": "<base64 ed25519 signature, see SignedMessage>"
+//	    }
+//	  }
+//	}
+//
+// The signature covers the version and platform along with the digest, so a
+// manifest cannot pass off an older signed build as a newer release.
+//
+// Relative URLs resolve against the manifest URL, so a plain static file server
+// is enough to host releases.
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// PublicKey is the base64 ed25519 key releases are signed with, set at build
+// time with -ldflags "-X github.com/cleverdata/sift-agent/internal/update.PublicKey=...".
+var PublicKey = ""
+
+type Build struct {
+	URL       string `json:"url"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+}
+
+type Manifest struct {
+	Version string           `json:"version"`
+	Builds  map[string]Build `json:"builds"`
+}
+
+// Platform returns the manifest key for the running binary, e.g. "windows-amd64".
+func Platform() string {
+	return runtime.GOOS + "-" + runtime.GOARCH
+}
+
+// SignedMessage returns the message a build's signature covers:
+//
+//	<version>\n<os>/<arch>\n<lowercase hex sha256>
+//
+// with the version exactly as in the manifest, e.g. "0.3.0\nlinux/amd64\n9f86...".
+func SignedMessage(version string, goos string, goarch string, sha256Hex string) []byte {
+	return []byte(version + "\n" + goos + "/" + goarch + "\n" + strings.ToLower(sha256Hex))
+}
+
+// FetchManifest downloads the release manifest and returns it with the build
+// for this platform, its URL resolved.
+func FetchManifest(ctx context.Context, manifestURL string) (Manifest, Build, error) {
+	var m Manifest
+	resp, err := resty.New().R().SetContext(ctx).SetResult(&m).ForceContentType("application/json").Get(manifestURL)
+	if err != nil {
+		return Manifest{}, Build{}, err
+	}
+	if resp.StatusCode() != 200 {
+		return Manifest{}, Build{}, fmt.Errorf("manifest request failed: %s", resp.Status())
+	}
+
+	b, ok := m.Builds[Platform()]
+	if !ok {
+		return m, Build{}, fmt.Errorf("release %s has no build for %s", m.Version, Platform())
+	}
+	base, err := url.Parse(manifestURL)
+	if err != nil {
+		return Manifest{}, Build{}, err
+	}
+	ref, err := url.Parse(b.URL)
+	if err != nil {
+		return Manifest{}, Build{}, fmt.Errorf("invalid build url: %w", err)
+	}
+	b.URL = base.ResolveReference(ref).String()
+	return m, b, nil
+}
+
+// Newer reports whether version a is newer than b. Versions are compared as
+// dot-separated numbers; a leading "v" and any pre-release suffix are ignored.
+func Newer(a, b string) bool {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := 0; i < max(len(pa), len(pb)); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+func versionParts(v string) []int {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	var parts []int
+	for _, p := range strings.Split(v, ".") {
+		n, _ := strconv.Atoi(p)
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+// Download fetches the build of version next to exe and verifies its digest
+// and signature. It returns the path of the staged binary.
+func Download(ctx context.Context, exe string, version string, b Build, publicKey string) (string, error) {
+	pub, err := parsePublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	staged := exe + ".new"
+	resp, err := resty.New().R().SetContext(ctx).SetOutput(staged).Get(b.URL)
+	if err != nil {
+		os.Remove(staged)
+		return "", err
+	}
+	if resp.StatusCode() != 200 {
+		os.Remove(staged)
+		return "", fmt.Errorf("download failed: %s", resp.Status())
+	}
+
+	if err := verify(staged, version, b, pub); err != nil {
+		os.Remove(staged)
+		return "", err
+	}
+	if err := os.Chmod(staged, 0755); err != nil {
+		os.Remove(staged)
+		return "", err
+	}
+	return staged, nil
+}
+
+func parsePublicKey(s string) (ed25519.PublicKey, error) {
+	if s == "" {
+		return nil, errors.New("no update signing key configured")
+	}
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid update signing key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func verify(path string, version string, b Build, pub ed25519.PublicKey) error {
+	digest, err := fileDigest(path)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(digest, b.SHA256) {
+		return fmt.Errorf("digest mismatch: manifest sha256 %s, downloaded %s", b.SHA256, digest)
+	}
+	sig, err := base64.StdEncoding.DecodeString(b.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	if !ed25519.Verify(pub, SignedMessage(version, runtime.GOOS, runtime.GOARCH, digest), sig) {
+		return errors.New("signature verification failed")
+	}
+	return nil
+}
+
+// SmokeTest runs the staged binary's version command and checks it reports
+// exactly the expected version, catching builds that cannot start on this
+// machine.
+func SmokeTest(ctx context.Context, staged string, version string) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, staged, "version").Output()
+	if err != nil {
+		return fmt.Errorf("new binary failed to run: %w", err)
+	}
+	// Prints "Sift Agent v<version>"
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 || strings.TrimPrefix(fields[len(fields)-1], "v") != strings.TrimPrefix(version, "v") {
+		return fmt.Errorf("new binary reports %q, expected version %s", strings.TrimSpace(string(out)), version)
+	}
+	return nil
+}
+
+// Swap moves the staged binary into place, keeping the current one as
+// exe.old for rollback. Each step is a rename, so exe is never partially
+// written.
+func Swap(exe string, staged string) error {
+	backup := exe + ".old"
+	os.Remove(backup)
+	if err := os.Rename(exe, backup); err != nil {
+		return fmt.Errorf("failed to back up current binary: %w", err)
+	}
+	if err := os.Rename(staged, exe); err != nil {
+		os.Rename(backup, exe)
+		return fmt.Errorf("failed to install new binary: %w", err)
+	}
+	return nil
+}
+
+// Rollback restores the binary saved by the last Swap. The replaced build of
+// version is rejected, so it is not installed again automatically.
+func Rollback(exe string, version string) error {
+	backup := exe + ".old"
+	if _, err := os.Stat(backup); err != nil {
+		return errors.New("no previous version to roll back to")
+	}
+	failed := exe + ".failed"
+	os.Remove(failed)
+	if err := os.Rename(exe, failed); err != nil {
+		return err
+	}
+	if err := os.Rename(backup, exe); err != nil {
+		os.Rename(failed, exe)
+		return err
+	}
+	os.Remove(markerPath(exe))
+	digest, err := fileDigest(failed)
+	if err != nil {
+		return err
+	}
+	return Reject(exe, version, digest)
+}
+
+// marker tracks an update on probation. The updater writes it before
+// restarting the service and the new agent marks it healthy once it is up.
+type marker struct {
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Healthy bool      `json:"healthy"`
+	At      time.Time `json:"at"`
+}
+
+func markerPath(exe string) string {
+	return exe + ".update"
+}
+
+func writeMarker(exe string, m marker) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := markerPath(exe) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, markerPath(exe))
+}
+
+func readMarker(exe string) (marker, bool) {
+	data, err := os.ReadFile(markerPath(exe))
+	if err != nil {
+		return marker{}, false
+	}
+	var m marker
+	if json.Unmarshal(data, &m) != nil {
+		return marker{}, false
+	}
+	return m, true
+}
+
+// BeginProbation records that exe was just updated from one version to another.
+func BeginProbation(exe string, from string, to string) error {
+	return writeMarker(exe, marker{From: from, To: to, At: time.Now()})
+}
+
+// ConfirmHealthy is called by a running agent. If exe is on probation for
+// this version, it is marked healthy once ready is closed, unless ctx ends
+// first. Without it the updater rolls back when its timeout expires.
+func ConfirmHealthy(ctx context.Context, exe string, version string, ready <-chan struct{}) {
+	m, ok := readMarker(exe)
+	if !ok || m.Healthy || m.To != version {
+		return
+	}
+	select {
+	case <-ready:
+		m.Healthy = true
+		m.At = time.Now()
+		writeMarker(exe, m)
+	case <-ctx.Done():
+	}
+}
+
+// WaitHealthy waits until the agent running version reports healthy.
+func WaitHealthy(ctx context.Context, exe string, version string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if m, ok := readMarker(exe); ok && m.Healthy && m.To == version {
+			return true
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return false
+}
+
+// Spawn starts exe with args detached from the current process, so an updater
+// launched by the service survives the service restart it triggers. Under
+// systemd it runs as a transient unit, outside the service's control group.
+func Spawn(exe string, args ...string) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "linux" && os.Getenv("INVOCATION_ID") != "" {
+		if systemdRun, err := exec.LookPath("systemd-run"); err == nil {
+			cmd = exec.Command(systemdRun, append([]string{"--collect", "--quiet", exe}, args...)...)
+		}
+	}
+	if cmd == nil {
+		cmd = exec.Command(exe, args...)
+		detach(cmd)
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// rejection is a build that failed to install or was rolled back.
+type rejection struct {
+	Version string    `json:"version"`
+	SHA256  string    `json:"sha256"`
+	At      time.Time `json:"at"`
+}
+
+func rejectedPath(exe string) string {
+	return exe + ".rejected"
+}
+
+// Reject records that the build of version with the given digest must not be
+// installed automatically again.
+func Reject(exe string, version string, sha256Hex string) error {
+	data, err := json.Marshal(rejection{Version: version, SHA256: strings.ToLower(sha256Hex), At: time.Now()})
+	if err != nil {
+		return err
+	}
+	tmp := rejectedPath(exe) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, rejectedPath(exe))
+}
+
+// Rejected reports whether the manifest still offers the build last rejected
+// by Reject. A new version or a rebuilt binary is offered again.
+func Rejected(exe string, m Manifest, b Build) bool {
+	data, err := os.ReadFile(rejectedPath(exe))
+	if err != nil {
+		return false
+	}
+	var r rejection
+	if json.Unmarshal(data, &r) != nil {
+		return false
+	}
+	return r.Version == m.Version && strings.EqualFold(r.SHA256, b.SHA256)
+}
+
+// Finish removes the probation marker and the backup of a healthy update.
+func Finish(exe string) {
+	os.Remove(markerPath(exe))
+	os.Remove(exe + ".old")
+}
@@ -0,0 +1,182 @@
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// release is a manifest server standing in for the release host.
+type release struct {
+	srv    *httptest.Server
+	priv   ed25519.PrivateKey
+	pub    string
+	binary []byte
+	sign   string // Version the build is signed for
+	offer  string // Version the manifest claims
+}
+
+func newRelease(t *testing.T, binary string, signed string, offered string) *release {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &release{priv: priv, pub: base64.StdEncoding.EncodeToString(pub), binary: []byte(binary), sign: signed, offer: offered}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/manifest.json", func(w http.ResponseWriter, _ *http.Request) {
+		json.NewEncoder(w).Encode(Manifest{Version: r.offer, Builds: map[string]Build{Platform(): r.build()}})
+	})
+	mux.HandleFunc("/sift", func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(r.binary)
+	})
+	r.srv = httptest.NewServer(mux)
+	t.Cleanup(r.srv.Close)
+	return r
+}
+
+func (r *release) build() Build {
+	sum := sha256.Sum256(r.binary)
+	digest := hex.EncodeToString(sum[:])
+	sig := ed25519.Sign(r.priv, SignedMessage(r.sign, runtime.GOOS, runtime.GOARCH, digest))
+	return Build{URL: "sift", SHA256: digest, Signature: base64.StdEncoding.EncodeToString(sig)}
+}
+
+// fakeAgent returns a script that answers "version" like the agent does.
+func fakeAgent(version string) string {
+	return "#!/bin/sh\necho 'Sift Agent v" + version + "'\n"
+}
+
+func installed(t *testing.T) string {
+	t.Helper()
+	exe := filepath.Join(t.TempDir(), "sift")
+	if err := os.WriteFile(exe, []byte(fakeAgent("0.2.0")), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return exe
+}
+
+func TestDownloadVerifiesSignedVersion(t *testing.T) {
+	r := newRelease(t, fakeAgent("1.0.0"), "1.0.0", "1.0.0")
+	exe := installed(t)
+
+	m, b, err := FetchManifest(context.Background(), r.srv.URL+"/manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	staged, err := Download(context.Background(), exe, m.Version, b, r.pub)
+	if err != nil {
+		t.Fatalf("correctly signed build rejected: %v", err)
+	}
+	os.Remove(staged)
+
+	other, _, _ := ed25519.GenerateKey(nil)
+	if _, err := Download(context.Background(), exe, m.Version, b, base64.StdEncoding.EncodeToString(other)); err == nil {
+		t.Fatal("build verified with the wrong key")
+	}
+}
+
+func TestDowngradeIsRejected(t *testing.T) {
+	// An old signed build offered under a newer version number
+	r := newRelease(t, fakeAgent("0.1.0"), "0.1.0", "1.0")
+	exe := installed(t)
+
+	m, b, err := FetchManifest(context.Background(), r.srv.URL+"/manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Newer(m.Version, "0.2.0") {
+		t.Fatal("manifest should claim a newer version")
+	}
+	if _, err := Download(context.Background(), exe, m.Version, b, r.pub); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Fatalf("signature for 0.1.0 accepted for 1.0: %v", err)
+	}
+	if _, err := os.Stat(exe + ".new"); !os.IsNotExist(err) {
+		t.Fatal("rejected download was left staged")
+	}
+}
+
+func TestSmokeTestComparesVersionExactly(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as the staged binary")
+	}
+	staged := filepath.Join(t.TempDir(), "sift.new")
+	if err := os.WriteFile(staged, []byte(fakeAgent("0.1.0")), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := SmokeTest(context.Background(), staged, "1.0"); err == nil {
+		t.Fatal("0.1.0 accepted as 1.0")
+	}
+	if err := SmokeTest(context.Background(), staged, "0.1"); err == nil {
+		t.Fatal("0.1.0 accepted as 0.1")
+	}
+	if err := SmokeTest(context.Background(), staged, "v0.1.0"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRolledBackBuildIsSkipped(t *testing.T) {
+	r := newRelease(t, fakeAgent("1.0.0"), "1.0.0", "1.0.0")
+	exe := installed(t)
+
+	m, b, err := FetchManifest(context.Background(), r.srv.URL+"/manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	staged, err := Download(context.Background(), exe, m.Version, b, r.pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Swap(exe, staged); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rollback(exe, m.Version); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(exe); string(data) != fakeAgent("0.2.0") {
+		t.Fatal("previous binary not restored")
+	}
+
+	if m, b, _ = FetchManifest(context.Background(), r.srv.URL+"/manifest.json"); !Rejected(exe, m, b) {
+		t.Fatal("rolled back build offered again")
+	}
+
+	// A rebuilt binary, or a new version, is offered again
+	r.binary = []byte(fakeAgent("1.0.0") + "# rebuilt\n")
+	if m, b, _ = FetchManifest(context.Background(), r.srv.URL+"/manifest.json"); Rejected(exe, m, b) {
+		t.Fatal("rebuilt binary still skipped")
+	}
+	r.binary, r.sign, r.offer = []byte(fakeAgent("1.0.1")), "1.0.1", "1.0.1"
+	if m, b, _ = FetchManifest(context.Background(), r.srv.URL+"/manifest.json"); Rejected(exe, m, b) {
+		t.Fatal("new version still skipped")
+	}
+}
+
+func TestHealthyOnlyOnceReady(t *testing.T) {
+	exe := installed(t)
+	if err := BeginProbation(exe, "0.2.0", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	ready := make(chan struct{})
+	go ConfirmHealthy(t.Context(), exe, "1.0.0", ready)
+
+	if WaitHealthy(t.Context(), exe, "1.0.0", 1500*time.Millisecond) {
+		t.Fatal("reported healthy before the agent was up")
+	}
+	close(ready)
+	if !WaitHealthy(t.Context(), exe, "1.0.0", 5*time.Second) {
+		t.Fatal("not reported healthy once the agent was up")
+	}
+}